@@ -426,6 +426,19 @@ func VerifyTLFCryptKeyServerHalfID(
 	return serverHalfID.ID.Verify(key, data)
 }
 
+// Matches returns whether id is the ID that MakeTLFCryptKeyServerHalfID
+// would produce for the given user, device, and server half.
+func (id TLFCryptKeyServerHalfID) Matches(
+	user keybase1.UID, devicePubKey CryptPublicKey,
+	serverHalf TLFCryptKeyServerHalf) (bool, error) {
+	expectedID, err := MakeTLFCryptKeyServerHalfID(
+		user, devicePubKey, serverHalf)
+	if err != nil {
+		return false, err
+	}
+	return id == expectedID, nil
+}
+
 // TLFCryptKeyClientHalf (t_u^{f,k,i} for a user u, a folder f, a key
 // generation k, and a device i) is the masked, client-side half of a
 // TLFCryptKey, which can be recovered only with both halves. (See
@@ -475,6 +488,17 @@ func prepareTLFCryptKeyClientHalf(
 	return nonce, nil
 }
 
+// ValidateEncryptedTLFCryptKeyClientHalf returns an error if the
+// given encrypted client half doesn't have the version, length, or
+// nonce length that EncryptTLFCryptKeyClientHalf produces, i.e. if
+// DecryptTLFCryptKeyClientHalf would reject it before even trying to
+// decrypt it.
+func ValidateEncryptedTLFCryptKeyClientHalf(
+	encryptedClientHalf EncryptedTLFCryptKeyClientHalf) error {
+	_, err := prepareTLFCryptKeyClientHalf(encryptedClientHalf)
+	return err
+}
+
 // DecryptTLFCryptKeyClientHalf decrypts a
 // TLFCryptKeyClientHalf using the given device private key
 // and the TLF's ephemeral public key.
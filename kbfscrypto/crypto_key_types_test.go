@@ -339,3 +339,31 @@ func TestUnmaskTLFCryptKey(t *testing.T) {
 	require.NotEqual(t, serverHalf.Data(), key.Data())
 	require.NotEqual(t, cryptKey.Data(), key.Data())
 }
+
+func TestTLFCryptKeyServerHalfIDMatches(t *testing.T) {
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+	key1 := MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := MakeFakeCryptPublicKeyOrBust("key2")
+	serverHalf1 := MakeTLFCryptKeyServerHalf([32]byte{0x1})
+	serverHalf2 := MakeTLFCryptKeyServerHalf([32]byte{0x2})
+
+	id, err := MakeTLFCryptKeyServerHalfID(uid1, key1, serverHalf1)
+	require.NoError(t, err)
+
+	matches, err := id.Matches(uid1, key1, serverHalf1)
+	require.NoError(t, err)
+	require.True(t, matches)
+
+	matches, err = id.Matches(uid2, key1, serverHalf1)
+	require.NoError(t, err)
+	require.False(t, matches)
+
+	matches, err = id.Matches(uid1, key2, serverHalf1)
+	require.NoError(t, err)
+	require.False(t, matches)
+
+	matches, err = id.Matches(uid1, key1, serverHalf2)
+	require.NoError(t, err)
+	require.False(t, matches)
+}
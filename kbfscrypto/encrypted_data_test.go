@@ -109,3 +109,35 @@ func TestCryptoCommonEncryptTLFCryptKeyClientHalf(t *testing.T) {
 	clientHalf2 := MakeTLFCryptKeyClientHalf(clientHalf2Data)
 	require.Equal(t, clientHalf, clientHalf2)
 }
+
+func TestValidateEncryptedTLFCryptKeyClientHalf(t *testing.T) {
+	_, ephPrivateKey, err := MakeRandomTLFEphemeralKeys()
+	require.NoError(t, err)
+
+	publicKey := MakeFakeCryptPrivateKeyOrBust("fake key").GetPublicKey()
+	clientHalf := MakeTLFCryptKeyClientHalf([32]byte{0x1})
+
+	encryptedClientHalf, err := EncryptTLFCryptKeyClientHalf(
+		ephPrivateKey, publicKey, clientHalf)
+	require.NoError(t, err)
+	require.NoError(t,
+		ValidateEncryptedTLFCryptKeyClientHalf(encryptedClientHalf))
+
+	wrongVersion := encryptedClientHalf
+	wrongVersion.Version = EncryptionSecretbox + 1
+	err = ValidateEncryptedTLFCryptKeyClientHalf(wrongVersion)
+	require.Equal(t,
+		UnknownEncryptionVer{wrongVersion.Version}, errors.Cause(err))
+
+	truncated := encryptedClientHalf
+	truncated.EncryptedData = encryptedClientHalf.EncryptedData[:len(
+		encryptedClientHalf.EncryptedData)-1]
+	err = ValidateEncryptedTLFCryptKeyClientHalf(truncated)
+	require.Error(t, err)
+
+	wrongNonceSize := encryptedClientHalf
+	wrongNonceSize.Nonce = encryptedClientHalf.Nonce[:8]
+	err = ValidateEncryptedTLFCryptKeyClientHalf(wrongNonceSize)
+	require.Equal(t,
+		InvalidNonceError{wrongNonceSize.Nonce}, errors.Cause(err))
+}
@@ -5,11 +5,19 @@
 package kbfsmd
 
 import (
+	"bytes"
 	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
 
+	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/go-codec/codec"
+	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfshash"
+	"github.com/pkg/errors"
 )
 
 // TLFCryptKeyInfo is a per-device key half entry in the
@@ -22,6 +30,14 @@ type TLFCryptKeyInfo struct {
 	codec.UnknownFieldSetHandler
 }
 
+// ValidateClientHalf returns an error if info's encrypted client half
+// doesn't have the version, length, or nonce length that
+// kbfscrypto.EncryptTLFCryptKeyClientHalf produces, e.g. because it
+// was truncated. See kbfscrypto.ValidateEncryptedTLFCryptKeyClientHalf.
+func (info TLFCryptKeyInfo) ValidateClientHalf() error {
+	return kbfscrypto.ValidateEncryptedTLFCryptKeyClientHalf(info.ClientHalf)
+}
+
 // DevicePublicKeys is a set of a user's devices (identified by the
 // corresponding device CryptPublicKey).
 type DevicePublicKeys map[kbfscrypto.CryptPublicKey]bool
@@ -41,6 +57,91 @@ func (dpk DevicePublicKeys) Equals(other DevicePublicKeys) bool {
 	return true
 }
 
+// IsStrictSubsetOf returns whether every key in dpk is also in other,
+// and other has at least one key that isn't in dpk.
+func (dpk DevicePublicKeys) IsStrictSubsetOf(other DevicePublicKeys) bool {
+	extra := 0
+	for k, v := range other {
+		if v && !dpk[k] {
+			extra++
+		}
+	}
+	if extra == 0 {
+		return false
+	}
+
+	for k, v := range dpk {
+		if v && !other[k] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isZeroCryptPublicKey returns whether the given key is the zero
+// CryptPublicKey, or a well-formed KID whose key bytes are all zero.
+// It returns an error if the key has a non-empty KID that doesn't
+// decode to a version, a key type, at least one key byte, and an ID
+// suffix.
+func isZeroCryptPublicKey(key kbfscrypto.CryptPublicKey) (bool, error) {
+	kid := key.KID()
+	if kid.IsNil() {
+		return true, nil
+	}
+	b := kid.ToBytes()
+	if len(b) < 4 {
+		return false, fmt.Errorf("malformed KID %s", kid)
+	}
+	// Skip the version and key type, and the ID suffix.
+	for _, x := range b[2 : len(b)-1] {
+		if x != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// HasZeroKey returns whether dpk contains the zero CryptPublicKey, or
+// a key whose key bytes are all zero, which is almost certainly a
+// bug, since encrypting a client half for it would be useless. It
+// returns an error for the first key (in string order) with a
+// malformed KID, since such a key can't be classified.
+func (dpk DevicePublicKeys) HasZeroKey() (bool, error) {
+	hasZeroKey := false
+	for _, key := range dpk.sortedKeys() {
+		if !dpk[key] {
+			continue
+		}
+		isZero, err := isZeroCryptPublicKey(key)
+		if err != nil {
+			return false, err
+		}
+		hasZeroKey = hasZeroKey || isZero
+	}
+	return hasZeroKey, nil
+}
+
+// deepCopy returns a copy of dpk that doesn't share its map.
+func (dpk DevicePublicKeys) deepCopy() DevicePublicKeys {
+	dpkCopy := make(DevicePublicKeys, len(dpk))
+	for k, v := range dpk {
+		dpkCopy[k] = v
+	}
+	return dpkCopy
+}
+
+// union returns a new set containing the keys in either dpk or other.
+func (dpk DevicePublicKeys) union(other DevicePublicKeys) DevicePublicKeys {
+	u := dpk.deepCopy()
+	for k, v := range other {
+		if v {
+			u[k] = true
+		}
+	}
+	return u
+}
+
 // UserDevicePublicKeys is a map from users to that user's set of devices.
 type UserDevicePublicKeys map[keybase1.UID]DevicePublicKeys
 
@@ -72,15 +173,285 @@ func (udpk UserDevicePublicKeys) Equals(other UserDevicePublicKeys) bool {
 	return true
 }
 
+// sortUIDs sorts the given UIDs in place and returns them.
+func sortUIDs(uids []keybase1.UID) []keybase1.UID {
+	sort.Slice(uids, func(i, j int) bool {
+		return uids[i] < uids[j]
+	})
+	return uids
+}
+
+// sortCryptPublicKeys sorts the given keys in place by their string
+// form and returns them.
+func sortCryptPublicKeys(
+	keys []kbfscrypto.CryptPublicKey) []kbfscrypto.CryptPublicKey {
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+	return keys
+}
+
+// sortServerHalfIDs sorts the given IDs in place by their string form
+// and returns them.
+func sortServerHalfIDs(
+	ids []kbfscrypto.TLFCryptKeyServerHalfID) []kbfscrypto.TLFCryptKeyServerHalfID {
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].String() < ids[j].String()
+	})
+	return ids
+}
+
+// sortedUIDs returns the users in udpk, sorted by UID.
+func (udpk UserDevicePublicKeys) sortedUIDs() []keybase1.UID {
+	uids := make([]keybase1.UID, 0, len(udpk))
+	for uid := range udpk {
+		uids = append(uids, uid)
+	}
+	return sortUIDs(uids)
+}
+
+// OwnerOf returns the user that has the given device, and whether
+// any such user was found. If more than one user (erroneously) has
+// the device, the one with the smallest UID is returned.
+func (udpk UserDevicePublicKeys) OwnerOf(
+	key kbfscrypto.CryptPublicKey) (keybase1.UID, bool) {
+	for _, uid := range udpk.sortedUIDs() {
+		if udpk[uid][key] {
+			return uid, true
+		}
+	}
+	return keybase1.UID(""), false
+}
+
+// difference returns the devices in udpk that aren't in other. Users
+// with no such devices are omitted.
+func (udpk UserDevicePublicKeys) difference(
+	other UserDevicePublicKeys) UserDevicePublicKeys {
+	diff := make(UserDevicePublicKeys)
+	for uid, keys := range udpk {
+		for key := range keys {
+			if other[uid][key] {
+				continue
+			}
+			if diff[uid] == nil {
+				diff[uid] = make(DevicePublicKeys)
+			}
+			diff[uid][key] = true
+		}
+	}
+	return diff
+}
+
+// sortedKeys returns the devices in dpk, sorted by their string form.
+func (dpk DevicePublicKeys) sortedKeys() []kbfscrypto.CryptPublicKey {
+	keys := make([]kbfscrypto.CryptPublicKey, 0, len(dpk))
+	for key := range dpk {
+		keys = append(keys, key)
+	}
+	return sortCryptPublicKeys(keys)
+}
+
+// Complement returns the devices in udpk that aren't in subset.
+// Users with no such devices are omitted.
+func (udpk UserDevicePublicKeys) Complement(
+	subset UserDevicePublicKeys) UserDevicePublicKeys {
+	return udpk.difference(subset)
+}
+
+// MergeWith returns a UserDevicePublicKeys with all the users in udpk
+// and other. For a user in both, onConflict is called with the user's
+// existing devices from udpk and incoming devices from other, and
+// its result is used as the user's devices. If onConflict is nil,
+// the union of the two sets is used.
+func (udpk UserDevicePublicKeys) MergeWith(other UserDevicePublicKeys,
+	onConflict func(uid keybase1.UID,
+		existing, incoming DevicePublicKeys) DevicePublicKeys) UserDevicePublicKeys {
+	if onConflict == nil {
+		onConflict = func(_ keybase1.UID,
+			existing, incoming DevicePublicKeys) DevicePublicKeys {
+			return existing.union(incoming)
+		}
+	}
+
+	merged := make(UserDevicePublicKeys, len(udpk)+len(other))
+	for uid, dpk := range udpk {
+		merged[uid] = dpk.deepCopy()
+	}
+	for uid, dpk := range other {
+		if existing, ok := merged[uid]; ok {
+			merged[uid] = onConflict(uid, existing, dpk.deepCopy())
+		} else {
+			merged[uid] = dpk.deepCopy()
+		}
+	}
+	return merged
+}
+
+// MergePreferringLargerPerUser returns a UserDevicePublicKeys with all
+// the users in udpk and other. For a user in both, the larger of the
+// two device sets is used, with ties going to udpk.
+func (udpk UserDevicePublicKeys) MergePreferringLargerPerUser(
+	other UserDevicePublicKeys) UserDevicePublicKeys {
+	return udpk.MergeWith(other, func(_ keybase1.UID,
+		existing, incoming DevicePublicKeys) DevicePublicKeys {
+		if len(incoming) > len(existing) {
+			return incoming
+		}
+		return existing
+	})
+}
+
+// Intersection returns a new UserDevicePublicKeys containing the
+// devices that are in both udpk and other. Users with no devices in
+// common are omitted.
+func (udpk UserDevicePublicKeys) Intersection(
+	other UserDevicePublicKeys) UserDevicePublicKeys {
+	intersection := make(UserDevicePublicKeys)
+	for uid, dpk := range udpk {
+		otherDPK, ok := other[uid]
+		if !ok {
+			continue
+		}
+		common := make(DevicePublicKeys)
+		for key, v := range dpk {
+			if v && otherDPK[key] {
+				common[key] = true
+			}
+		}
+		if len(common) > 0 {
+			intersection[uid] = common
+		}
+	}
+	return intersection
+}
+
+// FlattenDevices returns the set of all devices of all the users in
+// udpk. A device that belongs to more than one user appears once.
+func (udpk UserDevicePublicKeys) FlattenDevices() DevicePublicKeys {
+	devices := make(DevicePublicKeys)
+	for _, dpk := range udpk {
+		for key, v := range dpk {
+			if v {
+				devices[key] = true
+			}
+		}
+	}
+	return devices
+}
+
+// SingleDeviceUsers returns the users in udpk with exactly one
+// device, sorted by UID. Such users can't recover their data if they
+// lose that device.
+func (udpk UserDevicePublicKeys) SingleDeviceUsers() []keybase1.UID {
+	var uids []keybase1.UID
+	for _, uid := range udpk.sortedUIDs() {
+		if len(udpk[uid]) == 1 {
+			uids = append(uids, uid)
+		}
+	}
+	return uids
+}
+
+// UnchangedUsers returns the users in both udpk and other that have
+// the same set of devices in both, sorted by UID.
+func (udpk UserDevicePublicKeys) UnchangedUsers(
+	other UserDevicePublicKeys) []keybase1.UID {
+	var uids []keybase1.UID
+	for _, uid := range udpk.sortedUIDs() {
+		otherDPK, ok := other[uid]
+		if ok && udpk[uid].Equals(otherDPK) {
+			uids = append(uids, uid)
+		}
+	}
+	return uids
+}
+
+// ValidateKeys returns an error for the first device (in order of
+// UID and then key) in udpk whose key isn't a well-formed DH public
+// key, e.g. because it has the wrong key type or length.
+func (udpk UserDevicePublicKeys) ValidateKeys() error {
+	for _, uid := range udpk.sortedUIDs() {
+		for _, key := range udpk[uid].sortedKeys() {
+			_, err := libkb.ImportDHKeypairFromKID(key.KID())
+			if err != nil {
+				return errors.Wrapf(err,
+					"invalid device key %s for user %s", key, uid)
+			}
+		}
+	}
+	return nil
+}
+
+// DeviceChangeCounts is the number of devices a user gained and lost
+// between two rosters.
+type DeviceChangeCounts = struct {
+	Added, Removed int
+}
+
+// ChangeSummary returns, for each user whose devices differ between
+// prior and udpk, the number of devices in udpk but not prior (Added)
+// and the number in prior but not udpk (Removed). Users with no
+// changes are omitted.
+func (udpk UserDevicePublicKeys) ChangeSummary(
+	prior UserDevicePublicKeys) map[keybase1.UID]DeviceChangeCounts {
+	summary := make(map[keybase1.UID]DeviceChangeCounts)
+	for uid, keys := range udpk.difference(prior) {
+		counts := summary[uid]
+		counts.Added = len(keys)
+		summary[uid] = counts
+	}
+	for uid, keys := range prior.difference(udpk) {
+		counts := summary[uid]
+		counts.Removed = len(keys)
+		summary[uid] = counts
+	}
+	return summary
+}
+
+// ValidateAddRemoveDisjoint returns an error if any device is in both
+// added and removed, naming the first such device (sorted by user and
+// device).
+func ValidateAddRemoveDisjoint(added, removed UserDevicePublicKeys) error {
+	for _, uid := range added.sortedUIDs() {
+		for _, key := range added[uid].sortedKeys() {
+			if removed[uid][key] {
+				return fmt.Errorf(
+					"device %s for user %s is both added and removed",
+					key, uid)
+			}
+		}
+	}
+	return nil
+}
+
 // DeviceKeyServerHalves is a map from a user devices (identified by the
 // corresponding device CryptPublicKey) to corresponding key server
 // halves.
 type DeviceKeyServerHalves map[kbfscrypto.CryptPublicKey]kbfscrypto.TLFCryptKeyServerHalf
 
+// DeepCopy returns a copy of d that doesn't share its map.
+func (d DeviceKeyServerHalves) DeepCopy() DeviceKeyServerHalves {
+	dCopy := make(DeviceKeyServerHalves, len(d))
+	for key, serverHalf := range d {
+		dCopy[key] = serverHalf
+	}
+	return dCopy
+}
+
 // UserDeviceKeyServerHalves maps a user's keybase UID to their
 // DeviceServerHalves map.
 type UserDeviceKeyServerHalves map[keybase1.UID]DeviceKeyServerHalves
 
+// DeepCopy returns a copy of serverHalves that doesn't share any maps
+// with it.
+func (serverHalves UserDeviceKeyServerHalves) DeepCopy() UserDeviceKeyServerHalves {
+	serverHalvesCopy := make(UserDeviceKeyServerHalves, len(serverHalves))
+	for uid, deviceServerHalves := range serverHalves {
+		serverHalvesCopy[uid] = deviceServerHalves.DeepCopy()
+	}
+	return serverHalvesCopy
+}
+
 // MergeUsers returns a UserDeviceKeyServerHalves that contains all
 // the users in serverHalves and other, which must be disjoint. This
 // isn't a deep copy.
@@ -102,6 +473,264 @@ func (serverHalves UserDeviceKeyServerHalves) MergeUsers(
 	return merged, nil
 }
 
+// CountsByUser returns the number of device server halves for each
+// user in serverHalves, including users with no devices.
+func (serverHalves UserDeviceKeyServerHalves) CountsByUser() map[keybase1.UID]int {
+	counts := make(map[keybase1.UID]int, len(serverHalves))
+	for uid, deviceServerHalves := range serverHalves {
+		counts[uid] = len(deviceServerHalves)
+	}
+	return counts
+}
+
+// Reconcile compares serverHalves against the set of server half IDs
+// the server knows about. It returns the server halves whose IDs
+// aren't known to the server (and so need to be uploaded), and the
+// IDs known to the server that don't correspond to any of
+// serverHalves (and so need to be deleted), sorted by their string
+// form.
+func (serverHalves UserDeviceKeyServerHalves) Reconcile(
+	serverIDs map[kbfscrypto.TLFCryptKeyServerHalfID]bool) (
+	toUpload UserDeviceKeyServerHalves,
+	toDelete []kbfscrypto.TLFCryptKeyServerHalfID, err error) {
+	toUpload = make(UserDeviceKeyServerHalves)
+	localIDs := make(map[kbfscrypto.TLFCryptKeyServerHalfID]bool)
+	for uid, deviceServerHalves := range serverHalves {
+		for key, serverHalf := range deviceServerHalves {
+			id, err := kbfscrypto.MakeTLFCryptKeyServerHalfID(
+				uid, key, serverHalf)
+			if err != nil {
+				return nil, nil, err
+			}
+			localIDs[id] = true
+			if serverIDs[id] {
+				continue
+			}
+			if toUpload[uid] == nil {
+				toUpload[uid] = make(DeviceKeyServerHalves)
+			}
+			toUpload[uid][key] = serverHalf
+		}
+	}
+
+	for id := range serverIDs {
+		if !localIDs[id] {
+			toDelete = append(toDelete, id)
+		}
+	}
+	return toUpload, sortServerHalfIDs(toDelete), nil
+}
+
+// MergeStrict returns a UserDeviceKeyServerHalves that contains all
+// the users and devices in serverHalves and other. A device may be in
+// both only if it has the same server half in both; otherwise, an
+// error is returned.
+func (serverHalves UserDeviceKeyServerHalves) MergeStrict(
+	other UserDeviceKeyServerHalves) (UserDeviceKeyServerHalves, error) {
+	merged := make(UserDeviceKeyServerHalves,
+		len(serverHalves)+len(other))
+	for _, halves := range []UserDeviceKeyServerHalves{serverHalves, other} {
+		for uid, deviceServerHalves := range halves {
+			if merged[uid] == nil {
+				merged[uid] = make(DeviceKeyServerHalves,
+					len(deviceServerHalves))
+			}
+			for key, serverHalf := range deviceServerHalves {
+				if existing, ok := merged[uid][key]; ok &&
+					existing != serverHalf {
+					return nil, fmt.Errorf(
+						"conflicting server halves for user %s and device %s",
+						uid, key)
+				}
+				merged[uid][key] = serverHalf
+			}
+		}
+	}
+	return merged, nil
+}
+
+// ToRemovalTemplate returns a ServerHalfRemovalInfo with the same
+// users and devices as serverHalves, with empty server half ID lists
+// to be filled in later. Users in fullyRemoved are marked as removed.
+func (serverHalves UserDeviceKeyServerHalves) ToRemovalTemplate(
+	fullyRemoved map[keybase1.UID]bool) ServerHalfRemovalInfo {
+	template := make(ServerHalfRemovalInfo, len(serverHalves))
+	for uid, deviceServerHalves := range serverHalves {
+		deviceServerHalfIDs := make(DeviceServerHalfRemovalInfo,
+			len(deviceServerHalves))
+		for key := range deviceServerHalves {
+			deviceServerHalfIDs[key] =
+				[]kbfscrypto.TLFCryptKeyServerHalfID{}
+		}
+		template[uid] = UserServerHalfRemovalInfo{
+			UserRemoved:         fullyRemoved[uid],
+			DeviceServerHalfIDs: deviceServerHalfIDs,
+		}
+	}
+	return template
+}
+
+// UserDevice identifies a single device of a user.
+type UserDevice = struct {
+	UID keybase1.UID
+	Key kbfscrypto.CryptPublicKey
+}
+
+// sortUserDevices sorts the given devices in place by UID and then by
+// the string form of their keys, and returns them.
+func sortUserDevices(devices []UserDevice) []UserDevice {
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].UID != devices[j].UID {
+			return devices[i].UID < devices[j].UID
+		}
+		return devices[i].Key.String() < devices[j].Key.String()
+	})
+	return devices
+}
+
+// FindDuplicateHalves returns the groups of devices in serverHalves
+// that share an identical server half, which should never happen
+// legitimately. Each group is sorted by UID and key, and the groups
+// are sorted by their first device. An empty result means that all
+// server halves are distinct.
+func (serverHalves UserDeviceKeyServerHalves) FindDuplicateHalves() [][]UserDevice {
+	byHalf := make(map[kbfscrypto.TLFCryptKeyServerHalf][]UserDevice)
+	for uid, deviceServerHalves := range serverHalves {
+		for key, serverHalf := range deviceServerHalves {
+			byHalf[serverHalf] = append(
+				byHalf[serverHalf], UserDevice{uid, key})
+		}
+	}
+
+	var groups [][]UserDevice
+	for _, devices := range byHalf {
+		if len(devices) > 1 {
+			groups = append(groups, sortUserDevices(devices))
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		a, b := groups[i][0], groups[j][0]
+		if a.UID != b.UID {
+			return a.UID < b.UID
+		}
+		return a.Key.String() < b.Key.String()
+	})
+	return groups
+}
+
+// ForEachSorted calls fn for each device server half in
+// serverHalves, visiting users sorted by UID and then each user's
+// devices sorted by the string form of their keys.
+func (serverHalves UserDeviceKeyServerHalves) ForEachSorted(
+	fn func(keybase1.UID, kbfscrypto.CryptPublicKey,
+		kbfscrypto.TLFCryptKeyServerHalf)) {
+	uids := make([]keybase1.UID, 0, len(serverHalves))
+	for uid := range serverHalves {
+		uids = append(uids, uid)
+	}
+	for _, uid := range sortUIDs(uids) {
+		deviceServerHalves := serverHalves[uid]
+		keys := make([]kbfscrypto.CryptPublicKey, 0,
+			len(deviceServerHalves))
+		for key := range deviceServerHalves {
+			keys = append(keys, key)
+		}
+		for _, key := range sortCryptPublicKeys(keys) {
+			fn(uid, key, deviceServerHalves[key])
+		}
+	}
+}
+
+// UserDeviceKeyServerHalfEntry is a single device's server half in a
+// flattened UserDeviceKeyServerHalves.
+type UserDeviceKeyServerHalfEntry = struct {
+	UID  keybase1.UID
+	Key  kbfscrypto.CryptPublicKey
+	Half kbfscrypto.TLFCryptKeyServerHalf
+}
+
+// UserDeviceKeyServerHalvesFromEntries returns a
+// UserDeviceKeyServerHalves containing the given entries. It returns
+// an error if more than one entry is for the same user and device.
+func UserDeviceKeyServerHalvesFromEntries(
+	entries []UserDeviceKeyServerHalfEntry) (
+	UserDeviceKeyServerHalves, error) {
+	serverHalves := make(UserDeviceKeyServerHalves)
+	for _, entry := range entries {
+		deviceServerHalves, ok := serverHalves[entry.UID]
+		if !ok {
+			deviceServerHalves = make(DeviceKeyServerHalves)
+			serverHalves[entry.UID] = deviceServerHalves
+		}
+		if _, ok := deviceServerHalves[entry.Key]; ok {
+			return nil, fmt.Errorf(
+				"duplicate entry for user %s and device %s",
+				entry.UID, entry.Key)
+		}
+		deviceServerHalves[entry.Key] = entry.Half
+	}
+	return serverHalves, nil
+}
+
+// Entries returns all the device server halves in serverHalves as a
+// flat list, sorted by UID and then by the string form of each
+// device's key. It is the inverse of
+// UserDeviceKeyServerHalvesFromEntries.
+func (serverHalves UserDeviceKeyServerHalves) Entries() []UserDeviceKeyServerHalfEntry {
+	var entries []UserDeviceKeyServerHalfEntry
+	serverHalves.ForEachSorted(func(uid keybase1.UID,
+		key kbfscrypto.CryptPublicKey,
+		serverHalf kbfscrypto.TLFCryptKeyServerHalf) {
+		entries = append(entries,
+			UserDeviceKeyServerHalfEntry{uid, key, serverHalf})
+	})
+	return entries
+}
+
+// HalfChanged returns whether the given device's server half in
+// serverHalves differs from the one in other, and whether the device
+// has a server half in both. If it isn't in both, changed is true
+// only if it's in exactly one of them.
+func (serverHalves UserDeviceKeyServerHalves) HalfChanged(
+	other UserDeviceKeyServerHalves, uid keybase1.UID,
+	key kbfscrypto.CryptPublicKey) (changed bool, presentInBoth bool) {
+	serverHalf, ok := serverHalves[uid][key]
+	otherServerHalf, otherOK := other[uid][key]
+	if !ok || !otherOK {
+		return ok != otherOK, false
+	}
+	return serverHalf != otherServerHalf, true
+}
+
+// validateEphemeralPrivateKey returns an error if k is the zero key,
+// which would silently produce useless encrypted client halves.
+func validateEphemeralPrivateKey(k kbfscrypto.TLFEphemeralPrivateKey) error {
+	if k == (kbfscrypto.TLFEphemeralPrivateKey{}) {
+		return errors.New("zero ephemeral private key")
+	}
+	return nil
+}
+
+// ValidateEphemeralKeyPair returns an error if priv is the zero key,
+// or if pub isn't the public key corresponding to priv.
+func ValidateEphemeralKeyPair(priv kbfscrypto.TLFEphemeralPrivateKey,
+	pub kbfscrypto.TLFEphemeralPublicKey) error {
+	err := validateEphemeralPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+
+	keyPair, err := libkb.MakeNaclDHKeyPairFromSecret(priv.Data())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if [32]byte(keyPair.Public) != pub.Data() {
+		return errors.Errorf(
+			"ephemeral public key %s doesn't match private key", pub)
+	}
+	return nil
+}
+
 // splitTLFCryptKey splits the given TLFCryptKey into two parts -- the
 // client-side part (which is encrypted with the given keys), and the
 // server-side part, which will be uploaded to the server.
@@ -119,34 +748,83 @@ func splitTLFCryptKey(uid keybase1.UID,
 		return TLFCryptKeyInfo{}, kbfscrypto.TLFCryptKeyServerHalf{}, err
 	}
 
-	clientHalf := kbfscrypto.MaskTLFCryptKey(serverHalf, tlfCryptKey)
+	clientInfo, err := splitTLFCryptKeyWithServerHalf(
+		uid, tlfCryptKey, serverHalf, ePrivKey, ePubIndex, pubKey)
+	if err != nil {
+		return TLFCryptKeyInfo{}, kbfscrypto.TLFCryptKeyServerHalf{}, err
+	}
+	return clientInfo, serverHalf, nil
+}
+
+// ClientHalfFromServerHalf returns the client half of key that
+// corresponds to the given existing server half. Unlike
+// splitTLFCryptKey, it doesn't need any randomness, so it can be used
+// to re-encrypt the client half for a device without changing the
+// server half stored on the key server.
+func ClientHalfFromServerHalf(serverHalf kbfscrypto.TLFCryptKeyServerHalf,
+	key kbfscrypto.TLFCryptKey) kbfscrypto.TLFCryptKeyClientHalf {
+	return kbfscrypto.MaskTLFCryptKey(serverHalf, key)
+}
+
+// splitTLFCryptKeyWithServerHalf is like splitTLFCryptKey, except
+// that it uses the given server half instead of a new random one.
+func splitTLFCryptKeyWithServerHalf(uid keybase1.UID,
+	tlfCryptKey kbfscrypto.TLFCryptKey,
+	serverHalf kbfscrypto.TLFCryptKeyServerHalf,
+	ePrivKey kbfscrypto.TLFEphemeralPrivateKey, ePubIndex int,
+	pubKey kbfscrypto.CryptPublicKey) (TLFCryptKeyInfo, error) {
+	err := validateEphemeralPrivateKey(ePrivKey)
+	if err != nil {
+		return TLFCryptKeyInfo{}, err
+	}
+
+	clientHalf := ClientHalfFromServerHalf(serverHalf, tlfCryptKey)
 
 	var encryptedClientHalf kbfscrypto.EncryptedTLFCryptKeyClientHalf
 	encryptedClientHalf, err =
 		kbfscrypto.EncryptTLFCryptKeyClientHalf(ePrivKey, pubKey, clientHalf)
 	if err != nil {
-		return TLFCryptKeyInfo{}, kbfscrypto.TLFCryptKeyServerHalf{}, err
+		return TLFCryptKeyInfo{}, err
 	}
 
 	var serverHalfID kbfscrypto.TLFCryptKeyServerHalfID
 	serverHalfID, err =
 		kbfscrypto.MakeTLFCryptKeyServerHalfID(uid, pubKey, serverHalf)
 	if err != nil {
-		return TLFCryptKeyInfo{}, kbfscrypto.TLFCryptKeyServerHalf{}, err
+		return TLFCryptKeyInfo{}, err
 	}
 
-	clientInfo := TLFCryptKeyInfo{
+	return TLFCryptKeyInfo{
 		ClientHalf:   encryptedClientHalf,
 		ServerHalfID: serverHalfID,
 		EPubKeyIndex: ePubIndex,
-	}
-	return clientInfo, serverHalf, nil
+	}, nil
 }
 
 // DeviceServerHalfRemovalInfo is a map from a device's crypt public
 // key to a list of server halves to remove.
 type DeviceServerHalfRemovalInfo map[kbfscrypto.CryptPublicKey][]kbfscrypto.TLFCryptKeyServerHalfID
 
+// sortedKeys returns the devices in d, sorted by their string form.
+func (d DeviceServerHalfRemovalInfo) sortedKeys() []kbfscrypto.CryptPublicKey {
+	keys := make([]kbfscrypto.CryptPublicKey, 0, len(d))
+	for key := range d {
+		keys = append(keys, key)
+	}
+	return sortCryptPublicKeys(keys)
+}
+
+// AllIDs returns all the server half IDs in d, with devices sorted
+// by their string form and each device's IDs in their original
+// order.
+func (d DeviceServerHalfRemovalInfo) AllIDs() []kbfscrypto.TLFCryptKeyServerHalfID {
+	var ids []kbfscrypto.TLFCryptKeyServerHalfID
+	for _, key := range d.sortedKeys() {
+		ids = append(ids, d[key]...)
+	}
+	return ids
+}
+
 // UserServerHalfRemovalInfo contains a map from devices (identified
 // by its crypt public key) to a list of IDs for key server halves to
 // remove (one per key generation). For logging purposes, it also
@@ -157,6 +835,27 @@ type UserServerHalfRemovalInfo struct {
 	DeviceServerHalfIDs DeviceServerHalfRemovalInfo
 }
 
+// deepCopy returns a copy of ri that doesn't share any maps or slices
+// with it.
+func (ri UserServerHalfRemovalInfo) deepCopy() UserServerHalfRemovalInfo {
+	riCopy := UserServerHalfRemovalInfo{UserRemoved: ri.UserRemoved}
+	if ri.DeviceServerHalfIDs == nil {
+		return riCopy
+	}
+	riCopy.DeviceServerHalfIDs = make(DeviceServerHalfRemovalInfo,
+		len(ri.DeviceServerHalfIDs))
+	for key, serverHalfIDs := range ri.DeviceServerHalfIDs {
+		var idsCopy []kbfscrypto.TLFCryptKeyServerHalfID
+		if serverHalfIDs != nil {
+			idsCopy = make([]kbfscrypto.TLFCryptKeyServerHalfID,
+				len(serverHalfIDs))
+			copy(idsCopy, serverHalfIDs)
+		}
+		riCopy.DeviceServerHalfIDs[key] = idsCopy
+	}
+	return riCopy
+}
+
 // addGeneration merges the keys in genInfo (which must be one per
 // device) into ri. genInfo must have the same UserRemoved value and
 // keys as ri.
@@ -209,6 +908,15 @@ func (ri UserServerHalfRemovalInfo) addGeneration(
 // server half IDs to remove from the server.
 type ServerHalfRemovalInfo map[keybase1.UID]UserServerHalfRemovalInfo
 
+// sortedUIDs returns the users in info, sorted by UID.
+func (info ServerHalfRemovalInfo) sortedUIDs() []keybase1.UID {
+	uids := make([]keybase1.UID, 0, len(info))
+	for uid := range info {
+		uids = append(uids, uid)
+	}
+	return sortUIDs(uids)
+}
+
 // AddGeneration merges the keys in genInfo (which must be one per
 // device) into info. genInfo must have the same users as info.
 func (info ServerHalfRemovalInfo) AddGeneration(
@@ -250,3 +958,1778 @@ func (info ServerHalfRemovalInfo) MergeUsers(
 	}
 	return merged, nil
 }
+
+// Canonical returns a deep copy of info in canonical form: devices
+// with no server half IDs are dropped, users that aren't removed and
+// have no remaining devices are dropped, and every remaining user has
+// a non-nil device map. Removed users are always kept, even with no
+// devices (as RemoveDevicesNotIn produces for a user with no
+// devices), since the removal itself is meaningful. Two
+// logically-equal plans have equal canonical forms, so they also
+// serialize identically.
+func (info ServerHalfRemovalInfo) Canonical() ServerHalfRemovalInfo {
+	canonical := make(ServerHalfRemovalInfo, len(info))
+	for uid, userRemovalInfo := range info {
+		deviceServerHalfIDs := make(DeviceServerHalfRemovalInfo)
+		for key, serverHalfIDs := range userRemovalInfo.DeviceServerHalfIDs {
+			if len(serverHalfIDs) == 0 {
+				continue
+			}
+			idsCopy := make(
+				[]kbfscrypto.TLFCryptKeyServerHalfID, len(serverHalfIDs))
+			copy(idsCopy, serverHalfIDs)
+			deviceServerHalfIDs[key] = idsCopy
+		}
+		if len(deviceServerHalfIDs) == 0 && !userRemovalInfo.UserRemoved {
+			continue
+		}
+		canonical[uid] = UserServerHalfRemovalInfo{
+			UserRemoved:         userRemovalInfo.UserRemoved,
+			DeviceServerHalfIDs: deviceServerHalfIDs,
+		}
+	}
+	return canonical
+}
+
+// OrphanedEPubKeyIndices returns the indices in allIndices that
+// aren't referenced by any of the remaining key infos, in the order
+// they appear in allIndices. The ephemeral keys at those indices can
+// be dropped from the bundle.
+func OrphanedEPubKeyIndices(
+	remaining map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+	allIndices []int) []int {
+	referenced := make(map[int]bool)
+	for _, infos := range remaining {
+		for _, info := range infos {
+			referenced[info.EPubKeyIndex] = true
+		}
+	}
+
+	var orphaned []int
+	for _, index := range allIndices {
+		if !referenced[index] {
+			orphaned = append(orphaned, index)
+		}
+	}
+	return orphaned
+}
+
+// TouchedDevices returns the set of users and devices referenced
+// anywhere in info, regardless of how many server half IDs each
+// device has.
+func (info ServerHalfRemovalInfo) TouchedDevices() UserDevicePublicKeys {
+	touched := make(UserDevicePublicKeys, len(info))
+	for uid, userRemovalInfo := range info {
+		keys := make(DevicePublicKeys,
+			len(userRemovalInfo.DeviceServerHalfIDs))
+		for key := range userRemovalInfo.DeviceServerHalfIDs {
+			keys[key] = true
+		}
+		touched[uid] = keys
+	}
+	return touched
+}
+
+// keyInfosToPublicKeys returns the set of users and devices that have
+// an entry in infos. Users with no devices are omitted.
+func keyInfosToPublicKeys(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo) UserDevicePublicKeys {
+	publicKeys := make(UserDevicePublicKeys, len(infos))
+	for uid, deviceInfos := range infos {
+		if len(deviceInfos) == 0 {
+			continue
+		}
+		keys := make(DevicePublicKeys, len(deviceInfos))
+		for key := range deviceInfos {
+			keys[key] = true
+		}
+		publicKeys[uid] = keys
+	}
+	return publicKeys
+}
+
+// toPublicKeys returns the set of users and devices that have a
+// server half in serverHalves. Users with no devices are omitted.
+func (serverHalves UserDeviceKeyServerHalves) toPublicKeys() UserDevicePublicKeys {
+	publicKeys := make(UserDevicePublicKeys, len(serverHalves))
+	for uid, deviceServerHalves := range serverHalves {
+		if len(deviceServerHalves) == 0 {
+			continue
+		}
+		keys := make(DevicePublicKeys, len(deviceServerHalves))
+		for key := range deviceServerHalves {
+			keys[key] = true
+		}
+		publicKeys[uid] = keys
+	}
+	return publicKeys
+}
+
+// SymmetricDifference returns the devices that are in exactly one of
+// udpk and other. Users with no differing devices are omitted.
+func (udpk UserDevicePublicKeys) SymmetricDifference(
+	other UserDevicePublicKeys) UserDevicePublicKeys {
+	diff := make(UserDevicePublicKeys)
+	addDiff := func(a, b UserDevicePublicKeys) {
+		for uid, keys := range a {
+			for key := range keys {
+				if b[uid][key] {
+					continue
+				}
+				if diff[uid] == nil {
+					diff[uid] = make(DevicePublicKeys)
+				}
+				diff[uid][key] = true
+			}
+		}
+	}
+	addDiff(udpk, other)
+	addDiff(other, udpk)
+	return diff
+}
+
+// DeviceSetsAgree returns whether infos and halves cover exactly the
+// same set of devices. If they don't, it also returns the devices
+// covered by only one of them.
+func DeviceSetsAgree(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+	halves UserDeviceKeyServerHalves) (bool, UserDevicePublicKeys) {
+	diff := keyInfosToPublicKeys(infos).SymmetricDifference(
+		halves.toPublicKeys())
+	if len(diff) == 0 {
+		return true, nil
+	}
+	return false, diff
+}
+
+// ComputeServerHalfRemovalInfo returns a ServerHalfRemovalInfo for
+// all the devices in before that aren't in after, using idLookup to
+// get the server half IDs (one per key generation) for each removed
+// device. Users that aren't in after at all are marked as removed.
+func ComputeServerHalfRemovalInfo(before, after UserDevicePublicKeys,
+	idLookup func(uid keybase1.UID, key kbfscrypto.CryptPublicKey) (
+		[]kbfscrypto.TLFCryptKeyServerHalfID, error)) (
+	ServerHalfRemovalInfo, error) {
+	info := make(ServerHalfRemovalInfo)
+	for uid, keys := range before {
+		afterKeys, userInAfter := after[uid]
+		deviceServerHalfIDs := make(DeviceServerHalfRemovalInfo)
+		for key := range keys {
+			if afterKeys[key] {
+				continue
+			}
+			serverHalfIDs, err := idLookup(uid, key)
+			if err != nil {
+				return nil, err
+			}
+			if len(serverHalfIDs) == 0 {
+				return nil, fmt.Errorf(
+					"no server half IDs for user %s and device %s",
+					uid, key)
+			}
+			deviceServerHalfIDs[key] = serverHalfIDs
+		}
+
+		if len(deviceServerHalfIDs) == 0 {
+			continue
+		}
+
+		info[uid] = UserServerHalfRemovalInfo{
+			UserRemoved:         !userInAfter,
+			DeviceServerHalfIDs: deviceServerHalfIDs,
+		}
+	}
+	return info, nil
+}
+
+// clientHalvesEqual returns whether the two encrypted client halves
+// are identical.
+func clientHalvesEqual(
+	a, b kbfscrypto.EncryptedTLFCryptKeyClientHalf) bool {
+	return a.Version == b.Version &&
+		bytes.Equal(a.EncryptedData, b.EncryptedData) &&
+		bytes.Equal(a.Nonce, b.Nonce)
+}
+
+// KeyInfosEqualIgnoringIDs returns whether a and b have the same
+// devices with the same client halves and ephemeral key indices,
+// ignoring their server half IDs. This is useful when the IDs are
+// expected to be recomputed, e.g. across a format migration. Users
+// with no devices are ignored.
+func KeyInfosEqualIgnoringIDs(
+	a, b map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo) bool {
+	if !keyInfosToPublicKeys(a).Equals(keyInfosToPublicKeys(b)) {
+		return false
+	}
+
+	for uid, deviceInfos := range a {
+		for key, info := range deviceInfos {
+			otherInfo := b[uid][key]
+			if info.EPubKeyIndex != otherInfo.EPubKeyIndex {
+				return false
+			}
+			if !clientHalvesEqual(info.ClientHalf, otherInfo.ClientHalf) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ShardByUser splits info into n plans, assigning each user to a
+// bucket by hashing its UID, so the assignment is stable across
+// runs. The union of the returned plans is equal to info. This isn't
+// a deep copy. If n isn't positive, nil is returned.
+func (info ServerHalfRemovalInfo) ShardByUser(n int) []ServerHalfRemovalInfo {
+	if n <= 0 {
+		return nil
+	}
+
+	shards := make([]ServerHalfRemovalInfo, n)
+	for i := range shards {
+		shards[i] = make(ServerHalfRemovalInfo)
+	}
+	for uid, userRemovalInfo := range info {
+		h := fnv.New32a()
+		// Writes to a hash.Hash never return an error.
+		_, _ = h.Write(uid.ToBytes())
+		shards[h.Sum32()%uint32(n)][uid] = userRemovalInfo
+	}
+	return shards
+}
+
+// serverHalfIDsHavePrefix returns whether prefix is a prefix of ids.
+func serverHalfIDsHavePrefix(
+	ids, prefix []kbfscrypto.TLFCryptKeyServerHalfID) bool {
+	if len(prefix) > len(ids) {
+		return false
+	}
+	for i, id := range prefix {
+		if ids[i] != id {
+			return false
+		}
+	}
+	return true
+}
+
+// MergePreferringLonger returns a ServerHalfRemovalInfo that contains
+// all the users and devices in info and other. For a device in both,
+// the longer ID list is kept if the shorter one is a prefix of it;
+// otherwise, the IDs from info are kept. A user is marked as removed
+// if it is marked as removed in either plan. This isn't a deep copy.
+func (info ServerHalfRemovalInfo) MergePreferringLonger(
+	other ServerHalfRemovalInfo) ServerHalfRemovalInfo {
+	merged := make(ServerHalfRemovalInfo, len(info)+len(other))
+	for uid, userRemovalInfo := range info {
+		deviceServerHalfIDs := make(DeviceServerHalfRemovalInfo,
+			len(userRemovalInfo.DeviceServerHalfIDs))
+		for key, serverHalfIDs := range userRemovalInfo.DeviceServerHalfIDs {
+			deviceServerHalfIDs[key] = serverHalfIDs
+		}
+		merged[uid] = UserServerHalfRemovalInfo{
+			UserRemoved:         userRemovalInfo.UserRemoved,
+			DeviceServerHalfIDs: deviceServerHalfIDs,
+		}
+	}
+
+	for uid, otherRemovalInfo := range other {
+		mergedRemovalInfo, ok := merged[uid]
+		if !ok {
+			mergedRemovalInfo.DeviceServerHalfIDs =
+				make(DeviceServerHalfRemovalInfo)
+		}
+		mergedRemovalInfo.UserRemoved =
+			mergedRemovalInfo.UserRemoved || otherRemovalInfo.UserRemoved
+		for key, otherIDs := range otherRemovalInfo.DeviceServerHalfIDs {
+			ids, ok := mergedRemovalInfo.DeviceServerHalfIDs[key]
+			if !ok || (len(otherIDs) > len(ids) &&
+				serverHalfIDsHavePrefix(otherIDs, ids)) {
+				mergedRemovalInfo.DeviceServerHalfIDs[key] = otherIDs
+			}
+		}
+		merged[uid] = mergedRemovalInfo
+	}
+	return merged
+}
+
+// RekeyOutputIsEmpty returns whether the given rekey output contains
+// no key infos and no server halves, i.e. whether there's nothing to
+// write out.
+func RekeyOutputIsEmpty(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+	halves UserDeviceKeyServerHalves) bool {
+	for _, deviceInfos := range infos {
+		if len(deviceInfos) > 0 {
+			return false
+		}
+	}
+	for _, deviceServerHalves := range halves {
+		if len(deviceServerHalves) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// GenerationCount returns the number of key generations represented
+// in info, i.e. the maximum number of server half IDs for any
+// device. In a well-formed plan, every device has the same number of
+// IDs.
+func (info ServerHalfRemovalInfo) GenerationCount() int {
+	count := 0
+	for _, userRemovalInfo := range info {
+		for _, serverHalfIDs := range userRemovalInfo.DeviceServerHalfIDs {
+			if len(serverHalfIDs) > count {
+				count = len(serverHalfIDs)
+			}
+		}
+	}
+	return count
+}
+
+// RekeyOutputSummary returns a one-line summary of the given rekey
+// output, suitable for logging.
+func RekeyOutputSummary(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+	halves UserDeviceKeyServerHalves) string {
+	userCount := 0
+	deviceCount := 0
+	for _, deviceInfos := range infos {
+		if len(deviceInfos) > 0 {
+			userCount++
+			deviceCount += len(deviceInfos)
+		}
+	}
+	halfCount := 0
+	for _, deviceServerHalves := range halves {
+		halfCount += len(deviceServerHalves)
+	}
+	return fmt.Sprintf("rekeyed %d users / %d devices; %d server halves",
+		userCount, deviceCount, halfCount)
+}
+
+// mostCommonEPubKeyIndex returns the index with the highest count in
+// counts, breaking ties by the smallest index, along with its count.
+// If counts is empty, it returns (0, 0).
+func mostCommonEPubKeyIndex(counts map[int]int) (index, count int) {
+	for i, c := range counts {
+		if c > count || (c == count && i < index) {
+			index, count = i, c
+		}
+	}
+	return index, count
+}
+
+// DominantEPubKeyIndex returns the ephemeral key index referenced by
+// the most key infos in infos, along with the number of key infos
+// referencing it. Ties are broken by the smallest index. If infos is
+// empty, it returns (0, 0).
+func DominantEPubKeyIndex(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo) (
+	int, int) {
+	counts := make(map[int]int)
+	for _, deviceInfos := range infos {
+		for _, info := range deviceInfos {
+			counts[info.EPubKeyIndex]++
+		}
+	}
+	return mostCommonEPubKeyIndex(counts)
+}
+
+// CoversGenerations returns whether every device in info has exactly
+// expected server half IDs, i.e. whether the removal covers every key
+// generation. If not, it also returns a description of each
+// offending device, sorted by user and device.
+func (info ServerHalfRemovalInfo) CoversGenerations(expected int) (
+	bool, []string) {
+	var offending []string
+	for _, uid := range info.sortedUIDs() {
+		deviceServerHalfIDs := info[uid].DeviceServerHalfIDs
+		for _, key := range deviceServerHalfIDs.sortedKeys() {
+			idCount := len(deviceServerHalfIDs[key])
+			if idCount != expected {
+				offending = append(offending, fmt.Sprintf(
+					"user %s, device %s: expected %d IDs, got %d",
+					uid, key, expected, idCount))
+			}
+		}
+	}
+	return len(offending) == 0, offending
+}
+
+// ComputeServerHalfRemovalInfoCached is like
+// ComputeServerHalfRemovalInfo, except that it gets the server half
+// IDs for each removed device from idCache, and returns an error if a
+// removed device isn't in idCache.
+func ComputeServerHalfRemovalInfoCached(before, after UserDevicePublicKeys,
+	idCache map[keybase1.UID]map[kbfscrypto.CryptPublicKey][]kbfscrypto.TLFCryptKeyServerHalfID) (
+	ServerHalfRemovalInfo, error) {
+	return ComputeServerHalfRemovalInfo(before, after,
+		func(uid keybase1.UID, key kbfscrypto.CryptPublicKey) (
+			[]kbfscrypto.TLFCryptKeyServerHalfID, error) {
+			serverHalfIDs, ok := idCache[uid][key]
+			if !ok {
+				return nil, fmt.Errorf(
+					"no cached server half IDs for user %s and device %s",
+					uid, key)
+			}
+			return serverHalfIDs, nil
+		})
+}
+
+// AssembleKeyInfos returns a copy of the given per-user key infos,
+// combined into a single map. It returns an error if any user has a
+// nil device map.
+func AssembleKeyInfos(
+	perUser map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo) (
+	map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo, error) {
+	assembled := make(
+		map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+		len(perUser))
+	for uid, deviceInfos := range perUser {
+		if deviceInfos == nil {
+			return nil, fmt.Errorf("nil key infos for user %s", uid)
+		}
+		infosCopy := make(map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+			len(deviceInfos))
+		for key, info := range deviceInfos {
+			infosCopy[key] = info
+		}
+		assembled[uid] = infosCopy
+	}
+	return assembled, nil
+}
+
+// PartitionByReaderRekey splits infos into the entries with a
+// non-negative EPubKeyIndex (which use the writer ephemeral keys) and
+// those with a negative EPubKeyIndex (which were added by a reader
+// rekey). Users only appear in a partition if they have at least one
+// entry in it.
+func PartitionByReaderRekey(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo) (
+	writers, readers map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo) {
+	writers = make(map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo)
+	readers = make(map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo)
+	for uid, deviceInfos := range infos {
+		for key, info := range deviceInfos {
+			partition := writers
+			if info.EPubKeyIndex < 0 {
+				partition = readers
+			}
+			if partition[uid] == nil {
+				partition[uid] =
+					make(map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo)
+			}
+			partition[uid][key] = info
+		}
+	}
+	return writers, readers
+}
+
+// AllDevicesIn returns whether every device in info is also in
+// roster. If not, it also returns the devices that aren't.
+func (info ServerHalfRemovalInfo) AllDevicesIn(
+	roster UserDevicePublicKeys) (bool, UserDevicePublicKeys) {
+	unknown := info.TouchedDevices().difference(roster)
+	if len(unknown) == 0 {
+		return true, nil
+	}
+	return false, unknown
+}
+
+// ResplitWithNewEphemeral re-encrypts the client half of tlfCryptKey
+// for every device in pubKeys using newEPrivKey, while keeping each
+// device's existing server half from existing, so that nothing needs
+// to be changed on the key server. The returned key infos all use
+// newEPubIndex. It returns an error if a device in pubKeys has no
+// existing server half.
+func ResplitWithNewEphemeral(existing UserDeviceKeyServerHalves,
+	tlfCryptKey kbfscrypto.TLFCryptKey,
+	newEPrivKey kbfscrypto.TLFEphemeralPrivateKey, newEPubIndex int,
+	pubKeys UserDevicePublicKeys) (
+	map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo, error) {
+	infos := make(
+		map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+		len(pubKeys))
+	for uid, keys := range pubKeys {
+		deviceInfos := make(
+			map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo, len(keys))
+		for key := range keys {
+			serverHalf, ok := existing[uid][key]
+			if !ok {
+				return nil, fmt.Errorf(
+					"no existing server half for user %s and device %s",
+					uid, key)
+			}
+			info, err := splitTLFCryptKeyWithServerHalf(
+				uid, tlfCryptKey, serverHalf, newEPrivKey,
+				newEPubIndex, key)
+			if err != nil {
+				return nil, err
+			}
+			deviceInfos[key] = info
+		}
+		infos[uid] = deviceInfos
+	}
+	return infos, nil
+}
+
+// RekeyOutputUsers returns the users that have at least one key info
+// in infos, sorted by UID.
+func RekeyOutputUsers(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo) []keybase1.UID {
+	var uids []keybase1.UID
+	for uid, deviceInfos := range infos {
+		if len(deviceInfos) > 0 {
+			uids = append(uids, uid)
+		}
+	}
+	return sortUIDs(uids)
+}
+
+// AssertUniformGenerations returns an error if not every device in
+// info has the same number of server half IDs. The expected number
+// is the most common one (ties are broken by the larger number), and
+// the error names the first offending device, sorted by user and
+// device.
+func (info ServerHalfRemovalInfo) AssertUniformGenerations() error {
+	counts := make(map[int]int)
+	for _, userRemovalInfo := range info {
+		for _, serverHalfIDs := range userRemovalInfo.DeviceServerHalfIDs {
+			counts[len(serverHalfIDs)]++
+		}
+	}
+	if len(counts) <= 1 {
+		return nil
+	}
+
+	mode, modeCount := 0, 0
+	for idCount, deviceCount := range counts {
+		if deviceCount > modeCount ||
+			(deviceCount == modeCount && idCount > mode) {
+			mode, modeCount = idCount, deviceCount
+		}
+	}
+
+	for _, uid := range info.sortedUIDs() {
+		deviceServerHalfIDs := info[uid].DeviceServerHalfIDs
+		for _, key := range deviceServerHalfIDs.sortedKeys() {
+			idCount := len(deviceServerHalfIDs[key])
+			if idCount != mode {
+				return fmt.Errorf(
+					"expected %d keys, got %d for user %s and device %s",
+					mode, idCount, uid, key)
+			}
+		}
+	}
+	return nil
+}
+
+// NewUsersInRekey returns the users that have key infos in current
+// but not in prior, sorted by UID.
+func NewUsersInRekey(current,
+	prior map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo) []keybase1.UID {
+	var uids []keybase1.UID
+	for _, uid := range RekeyOutputUsers(current) {
+		if len(prior[uid]) == 0 {
+			uids = append(uids, uid)
+		}
+	}
+	return uids
+}
+
+// deviceServerHalfRemovalEntry is the canonical serialized form of a
+// single device's entry in a ServerHalfRemovalInfo.
+type deviceServerHalfRemovalEntry struct {
+	Key           kbfscrypto.CryptPublicKey            `codec:"k"`
+	ServerHalfIDs []kbfscrypto.TLFCryptKeyServerHalfID `codec:"i"`
+}
+
+// userServerHalfRemovalEntry is the canonical serialized form of a
+// single user's entry in a ServerHalfRemovalInfo.
+type userServerHalfRemovalEntry struct {
+	UID         keybase1.UID                   `codec:"u"`
+	UserRemoved bool                           `codec:"r"`
+	Devices     []deviceServerHalfRemovalEntry `codec:"d"`
+}
+
+// sortedEntries returns info as a list of users sorted by UID, each
+// with a list of devices sorted by the string form of their keys.
+// Every user and device in info is kept, and nil device maps and
+// server half ID lists stay nil.
+func (info ServerHalfRemovalInfo) sortedEntries() []userServerHalfRemovalEntry {
+	entries := make([]userServerHalfRemovalEntry, 0, len(info))
+	for _, uid := range info.sortedUIDs() {
+		userRemovalInfo := info[uid]
+		deviceServerHalfIDs := userRemovalInfo.DeviceServerHalfIDs
+		var devices []deviceServerHalfRemovalEntry
+		if deviceServerHalfIDs != nil {
+			devices = make([]deviceServerHalfRemovalEntry, 0,
+				len(deviceServerHalfIDs))
+		}
+		for _, key := range deviceServerHalfIDs.sortedKeys() {
+			devices = append(devices, deviceServerHalfRemovalEntry{
+				Key:           key,
+				ServerHalfIDs: deviceServerHalfIDs[key],
+			})
+		}
+		entries = append(entries, userServerHalfRemovalEntry{
+			UID:         uid,
+			UserRemoved: userRemovalInfo.UserRemoved,
+			Devices:     devices,
+		})
+	}
+	return entries
+}
+
+// canonicalEntries returns the canonical form of info (see
+// Canonical) as a list of sorted entries.
+func (info ServerHalfRemovalInfo) canonicalEntries() []userServerHalfRemovalEntry {
+	return info.Canonical().sortedEntries()
+}
+
+// SignatureInput returns a canonical serialization of info using the
+// given codec, suitable for signing. Users and devices are sorted,
+// and each device's server half IDs are kept in generation order.
+// Plans with equal canonical forms produce the same bytes.
+func (info ServerHalfRemovalInfo) SignatureInput(
+	codec kbfscodec.Codec) ([]byte, error) {
+	return codec.Encode(info.canonicalEntries())
+}
+
+// DeviceCountsBySplit returns the number of devices in info belonging
+// to users that were removed entirely, and the number belonging to
+// users that only lost some of their devices.
+func (info ServerHalfRemovalInfo) DeviceCountsBySplit() (
+	fullyRemovedDevices, partiallyRemovedDevices int) {
+	for _, userRemovalInfo := range info {
+		deviceCount := len(userRemovalInfo.DeviceServerHalfIDs)
+		if userRemovalInfo.UserRemoved {
+			fullyRemovedDevices += deviceCount
+		} else {
+			partiallyRemovedDevices += deviceCount
+		}
+	}
+	return fullyRemovedDevices, partiallyRemovedDevices
+}
+
+// ForUser returns a deep copy of the given user's entry in info, and
+// whether the user is in info at all.
+func (info ServerHalfRemovalInfo) ForUser(uid keybase1.UID) (
+	UserServerHalfRemovalInfo, bool) {
+	userRemovalInfo, ok := info[uid]
+	if !ok {
+		return UserServerHalfRemovalInfo{}, false
+	}
+	return userRemovalInfo.deepCopy(), true
+}
+
+// SetUser adds the given user's entry to info, allocating info first
+// if it's nil. It returns an error if the user is already in info.
+// This isn't a deep copy.
+func (info *ServerHalfRemovalInfo) SetUser(
+	uid keybase1.UID, ri UserServerHalfRemovalInfo) error {
+	if _, ok := (*info)[uid]; ok {
+		return fmt.Errorf(
+			"user %s is already in the ServerHalfRemovalInfo", uid)
+	}
+	if *info == nil {
+		*info = make(ServerHalfRemovalInfo)
+	}
+	(*info)[uid] = ri
+	return nil
+}
+
+// RekeyOutputsSameRoster returns whether a and b have key infos for
+// exactly the same devices, regardless of the contents of those key
+// infos.
+func RekeyOutputsSameRoster(
+	a, b map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo) bool {
+	return keyInfosToPublicKeys(a).Equals(keyInfosToPublicKeys(b))
+}
+
+// DevicesUsingEPubKeyIndex returns the devices whose key infos in
+// infos use the ephemeral key with the given index. If that
+// ephemeral key is compromised, only those devices need to be
+// re-split.
+func DevicesUsingEPubKeyIndex(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+	index int) UserDevicePublicKeys {
+	devices := make(UserDevicePublicKeys)
+	for uid, deviceInfos := range infos {
+		for key, info := range deviceInfos {
+			if info.EPubKeyIndex != index {
+				continue
+			}
+			if devices[uid] == nil {
+				devices[uid] = make(DevicePublicKeys)
+			}
+			devices[uid][key] = true
+		}
+	}
+	return devices
+}
+
+// ValidateRekeyOutputSize returns an error if infos has key infos for
+// more than maxDevices devices in total. This guards against
+// pathologically large rosters before the output is committed.
+func ValidateRekeyOutputSize(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+	maxDevices int) error {
+	deviceCount := 0
+	for _, deviceInfos := range infos {
+		deviceCount += len(deviceInfos)
+	}
+	if deviceCount > maxDevices {
+		return fmt.Errorf("device count=%d > max device count=%d",
+			deviceCount, maxDevices)
+	}
+	return nil
+}
+
+// MergeKeyInfos returns a new map with all the key infos in base and
+// updates. For a device in both, the key info from updates is used.
+// Neither base nor updates is modified.
+func MergeKeyInfos(base,
+	updates map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo) (
+	merged map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo) {
+	merged = make(
+		map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+		len(base))
+	add := func(
+		infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo) {
+		for uid, deviceInfos := range infos {
+			if merged[uid] == nil {
+				merged[uid] = make(
+					map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+					len(deviceInfos))
+			}
+			for key, info := range deviceInfos {
+				merged[uid][key] = info
+			}
+		}
+	}
+	add(base)
+	add(updates)
+	return merged
+}
+
+// FindOrphanedServerHalves returns the server halves in halves whose
+// devices have no key info in infos. Such server halves are dead
+// data.
+func FindOrphanedServerHalves(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+	halves UserDeviceKeyServerHalves) UserDeviceKeyServerHalves {
+	orphaned := make(UserDeviceKeyServerHalves)
+	for uid, deviceServerHalves := range halves {
+		for key, serverHalf := range deviceServerHalves {
+			if _, ok := infos[uid][key]; ok {
+				continue
+			}
+			if orphaned[uid] == nil {
+				orphaned[uid] = make(DeviceKeyServerHalves)
+			}
+			orphaned[uid][key] = serverHalf
+		}
+	}
+	return orphaned
+}
+
+// RekeyCoverage returns the fraction, between 0 and 1, of the devices
+// in target that have a server half in done. If target has no
+// devices, the rekey is trivially complete and 1 is returned.
+func RekeyCoverage(
+	done UserDeviceKeyServerHalves, target UserDevicePublicKeys) float64 {
+	total := 0
+	covered := 0
+	for uid, keys := range target {
+		for key := range keys {
+			total++
+			if _, ok := done[uid][key]; ok {
+				covered++
+			}
+		}
+	}
+	if total == 0 {
+		return 1
+	}
+	return float64(covered) / float64(total)
+}
+
+// ServerHalfRemovalInfoFromIDs returns a ServerHalfRemovalInfo
+// containing the given server half IDs, grouped by user and device.
+// Users in fullyRemoved are marked as removed. It returns an error if
+// any device has no IDs. The ID slices aren't copied.
+func ServerHalfRemovalInfoFromIDs(
+	ids map[keybase1.UID]map[kbfscrypto.CryptPublicKey][]kbfscrypto.TLFCryptKeyServerHalfID,
+	fullyRemoved map[keybase1.UID]bool) (ServerHalfRemovalInfo, error) {
+	info := make(ServerHalfRemovalInfo, len(ids))
+	for uid, deviceIDs := range ids {
+		deviceServerHalfIDs := make(DeviceServerHalfRemovalInfo,
+			len(deviceIDs))
+		for key, serverHalfIDs := range deviceIDs {
+			if len(serverHalfIDs) == 0 {
+				return nil, fmt.Errorf(
+					"no server half IDs for user %s and device %s",
+					uid, key)
+			}
+			deviceServerHalfIDs[key] = serverHalfIDs
+		}
+		info[uid] = UserServerHalfRemovalInfo{
+			UserRemoved:         fullyRemoved[uid],
+			DeviceServerHalfIDs: deviceServerHalfIDs,
+		}
+	}
+	return info, nil
+}
+
+// FindDuplicateServerHalfIDs returns the server half IDs in infos
+// that are used by more than one device, mapped to those devices
+// (sorted by their string form). An empty result means that there
+// are no duplicates.
+func FindDuplicateServerHalfIDs(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo) map[kbfscrypto.TLFCryptKeyServerHalfID][]kbfscrypto.CryptPublicKey {
+	byID := make(
+		map[kbfscrypto.TLFCryptKeyServerHalfID][]kbfscrypto.CryptPublicKey)
+	for _, deviceInfos := range infos {
+		for key, info := range deviceInfos {
+			byID[info.ServerHalfID] = append(byID[info.ServerHalfID], key)
+		}
+	}
+
+	duplicates := make(
+		map[kbfscrypto.TLFCryptKeyServerHalfID][]kbfscrypto.CryptPublicKey)
+	for id, keys := range byID {
+		if len(keys) > 1 {
+			duplicates[id] = sortCryptPublicKeys(keys)
+		}
+	}
+	return duplicates
+}
+
+// ServerHalvesDelta returns the number of devices that have a server
+// half in current but not in prior (added), in prior but not in
+// current (removed), and in both but with different server halves
+// (changed).
+func ServerHalvesDelta(prior, current UserDeviceKeyServerHalves) (
+	added, removed, changed int) {
+	for uid, deviceServerHalves := range current {
+		for key, serverHalf := range deviceServerHalves {
+			priorServerHalf, ok := prior[uid][key]
+			if !ok {
+				added++
+			} else if priorServerHalf != serverHalf {
+				changed++
+			}
+		}
+	}
+	for uid, deviceServerHalves := range prior {
+		for key := range deviceServerHalves {
+			if _, ok := current[uid][key]; !ok {
+				removed++
+			}
+		}
+	}
+	return added, removed, changed
+}
+
+// RekeyOutputHasDevice returns whether infos has a key info for the
+// given user's device.
+func RekeyOutputHasDevice(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+	uid keybase1.UID, key kbfscrypto.CryptPublicKey) bool {
+	_, ok := infos[uid][key]
+	return ok
+}
+
+// isZeroServerHalfID returns whether the given ID is the zero value,
+// or has all-zero hash data.
+func isZeroServerHalfID(id kbfscrypto.TLFCryptKeyServerHalfID) bool {
+	b := id.ID.Bytes()
+	if len(b) > 0 {
+		// Skip the hash type.
+		b = b[1:]
+	}
+	for _, x := range b {
+		if x != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ServerHalfRemovalInfoLocation identifies a single server half ID
+// in a ServerHalfRemovalInfo.
+type ServerHalfRemovalInfoLocation = struct {
+	UID   keybase1.UID
+	Key   kbfscrypto.CryptPublicKey
+	Index int
+}
+
+// FindZeroIDs returns the locations of all the zero server half IDs
+// in info, sorted by UID, then by key, then by index. Such IDs almost
+// certainly indicate a bug in building info, so this should be
+// checked before sending any deletes.
+func (info ServerHalfRemovalInfo) FindZeroIDs() []ServerHalfRemovalInfoLocation {
+	var locations []ServerHalfRemovalInfoLocation
+	for _, uid := range info.sortedUIDs() {
+		deviceServerHalfIDs := info[uid].DeviceServerHalfIDs
+		for _, key := range deviceServerHalfIDs.sortedKeys() {
+			for i, id := range deviceServerHalfIDs[key] {
+				if isZeroServerHalfID(id) {
+					locations = append(locations,
+						ServerHalfRemovalInfoLocation{uid, key, i})
+				}
+			}
+		}
+	}
+	return locations
+}
+
+// describeDevices returns a description of each device in udpk,
+// sorted by user and device.
+func (udpk UserDevicePublicKeys) describeDevices() []string {
+	var descriptions []string
+	for _, uid := range udpk.sortedUIDs() {
+		for _, key := range udpk[uid].sortedKeys() {
+			descriptions = append(descriptions,
+				fmt.Sprintf("user %s, device %s", uid, key))
+		}
+	}
+	return descriptions
+}
+
+// AssertRekeyOutputRoster returns an error describing the missing and
+// extra devices if infos doesn't have key infos for exactly the
+// devices in expected, and nil otherwise.
+func AssertRekeyOutputRoster(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+	expected UserDevicePublicKeys) error {
+	actual := keyInfosToPublicKeys(infos)
+	missing := expected.difference(actual)
+	extra := actual.difference(expected)
+	if len(missing) == 0 && len(extra) == 0 {
+		return nil
+	}
+	return fmt.Errorf(
+		"rekey output roster mismatch: missing=[%s], extra=[%s]",
+		strings.Join(missing.describeDevices(), "; "),
+		strings.Join(extra.describeDevices(), "; "))
+}
+
+// These are rough estimates of the encoded size of the parts of a
+// ServerHalfRemovalInfo, used by EstimatedByteSize.
+const (
+	estimatedServerHalfIDSize = 1 + 32 + 2
+	estimatedDeviceOverhead   = 1 + 35 + 2
+	estimatedUserOverhead     = 1 + 32 + 1 + 2
+)
+
+// EstimatedByteSize returns a rough estimate of the encoded size of
+// info, which grows with the total number of server half IDs. This is
+// useful to decide when to split up a large removal.
+func (info ServerHalfRemovalInfo) EstimatedByteSize() int {
+	size := 0
+	for _, userRemovalInfo := range info {
+		size += estimatedUserOverhead
+		for _, serverHalfIDs := range userRemovalInfo.DeviceServerHalfIDs {
+			size += estimatedDeviceOverhead +
+				len(serverHalfIDs)*estimatedServerHalfIDSize
+		}
+	}
+	return size
+}
+
+// MakeUserFullRemovalInfo returns a UserServerHalfRemovalInfo which
+// removes the user with the given devices entirely, using idsByDevice
+// to get the server half IDs for each device. It returns an error if
+// any of the devices has no server half IDs in idsByDevice.
+func MakeUserFullRemovalInfo(devices DevicePublicKeys,
+	idsByDevice map[kbfscrypto.CryptPublicKey][]kbfscrypto.TLFCryptKeyServerHalfID) (
+	UserServerHalfRemovalInfo, error) {
+	deviceServerHalfIDs := make(DeviceServerHalfRemovalInfo, len(devices))
+	for _, key := range devices.sortedKeys() {
+		serverHalfIDs := idsByDevice[key]
+		if len(serverHalfIDs) == 0 {
+			return UserServerHalfRemovalInfo{}, fmt.Errorf(
+				"no server half IDs for device %s", key)
+		}
+		deviceServerHalfIDs[key] = append(
+			[]kbfscrypto.TLFCryptKeyServerHalfID(nil), serverHalfIDs...)
+	}
+	return UserServerHalfRemovalInfo{
+		UserRemoved:         true,
+		DeviceServerHalfIDs: deviceServerHalfIDs,
+	}, nil
+}
+
+// HasReaderRekeyEntries returns whether any key info in infos has a
+// negative EPubKeyIndex, i.e. whether infos contains any entries
+// added by a reader rekey.
+func HasReaderRekeyEntries(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo) bool {
+	for _, deviceInfos := range infos {
+		for _, info := range deviceInfos {
+			if info.EPubKeyIndex < 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DeviceGenerationSpans returns, for each device with a server half
+// in any element of perGen, the (increasing) indices into perGen of
+// the elements in which it has a server half.
+func DeviceGenerationSpans(perGen []UserDeviceKeyServerHalves) map[keybase1.UID]map[kbfscrypto.CryptPublicKey][]int {
+	spans := make(map[keybase1.UID]map[kbfscrypto.CryptPublicKey][]int)
+	for i, serverHalves := range perGen {
+		for uid, deviceServerHalves := range serverHalves {
+			for key := range deviceServerHalves {
+				if spans[uid] == nil {
+					spans[uid] = make(
+						map[kbfscrypto.CryptPublicKey][]int)
+				}
+				spans[uid][key] = append(spans[uid][key], i)
+			}
+		}
+	}
+	return spans
+}
+
+// UnionServerHalfRemovalInfos combines perGen, each element of which
+// must have exactly one server half ID per device, into a single
+// ServerHalfRemovalInfo with the IDs for each device in the order of
+// perGen. All the elements of perGen must have the same users and
+// devices, as with AddGeneration. The elements of perGen aren't
+// modified.
+func UnionServerHalfRemovalInfos(perGen []ServerHalfRemovalInfo) (
+	ServerHalfRemovalInfo, error) {
+	union := make(ServerHalfRemovalInfo)
+	if len(perGen) == 0 {
+		return union, nil
+	}
+
+	for uid, ri := range perGen[0] {
+		for key, serverHalfIDs := range ri.DeviceServerHalfIDs {
+			if len(serverHalfIDs) != 1 {
+				return nil, fmt.Errorf(
+					"expected exactly one key, got %d for user %s and device %s",
+					len(serverHalfIDs), uid, key)
+			}
+		}
+		union[uid] = ri.deepCopy()
+	}
+
+	for _, genInfo := range perGen[1:] {
+		err := union.AddGeneration(genInfo)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return union, nil
+}
+
+// DeviceCountPerGeneration returns, for each generation index, the
+// number of devices in info that have a server half ID at that
+// index. For a plan that covers every generation for every device,
+// all the counts are equal.
+func (info ServerHalfRemovalInfo) DeviceCountPerGeneration() []int {
+	var counts []int
+	for _, userRemovalInfo := range info {
+		for _, serverHalfIDs := range userRemovalInfo.DeviceServerHalfIDs {
+			for len(counts) < len(serverHalfIDs) {
+				counts = append(counts, 0)
+			}
+			for i := range serverHalfIDs {
+				counts[i]++
+			}
+		}
+	}
+	return counts
+}
+
+// Encode returns a serialization of info using the given codec. It
+// encodes every user and device in info, including removed users
+// with no devices and devices with no server half IDs, with users and
+// devices sorted so that the same plan always produces the same
+// bytes. Unlike SignatureInput, it doesn't canonicalize info first,
+// so Decode gives back exactly the original plan.
+//
+// This is separate from the default codec encoding of
+// ServerHalfRemovalInfo (a plain map), which is left unchanged.
+func (info ServerHalfRemovalInfo) Encode(
+	codec kbfscodec.Codec) ([]byte, error) {
+	return codec.Encode(info.sortedEntries())
+}
+
+// Decode sets info to the plan serialized in buf by Encode, using
+// the given codec.
+func (info *ServerHalfRemovalInfo) Decode(
+	codec kbfscodec.Codec, buf []byte) error {
+	var entries []userServerHalfRemovalEntry
+	err := codec.Decode(buf, &entries)
+	if err != nil {
+		return err
+	}
+
+	decoded := make(ServerHalfRemovalInfo, len(entries))
+	for _, entry := range entries {
+		if _, ok := decoded[entry.UID]; ok {
+			return fmt.Errorf("duplicate entry for user %s", entry.UID)
+		}
+		var deviceServerHalfIDs DeviceServerHalfRemovalInfo
+		if entry.Devices != nil {
+			deviceServerHalfIDs = make(
+				DeviceServerHalfRemovalInfo, len(entry.Devices))
+		}
+		for _, device := range entry.Devices {
+			if _, ok := deviceServerHalfIDs[device.Key]; ok {
+				return fmt.Errorf(
+					"duplicate entry for user %s and device %s",
+					entry.UID, device.Key)
+			}
+			deviceServerHalfIDs[device.Key] = device.ServerHalfIDs
+		}
+		decoded[entry.UID] = UserServerHalfRemovalInfo{
+			UserRemoved:         entry.UserRemoved,
+			DeviceServerHalfIDs: deviceServerHalfIDs,
+		}
+	}
+	*info = decoded
+	return nil
+}
+
+// RekeyOutputIsSuperset returns whether every device with a key info
+// in prior also has one in current, i.e. whether going from prior to
+// current didn't drop any devices.
+func RekeyOutputIsSuperset(
+	current, prior map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo) bool {
+	dropped := keyInfosToPublicKeys(prior).difference(
+		keyInfosToPublicKeys(current))
+	return len(dropped) == 0
+}
+
+// FirstGenerationForDevice returns the lowest generation index at
+// which the given device has a non-zero server half ID in info (or -1
+// if it has none), and whether the device is in info at all.
+func (info ServerHalfRemovalInfo) FirstGenerationForDevice(
+	uid keybase1.UID, key kbfscrypto.CryptPublicKey) (int, bool) {
+	serverHalfIDs, ok := info[uid].DeviceServerHalfIDs[key]
+	if !ok {
+		return -1, false
+	}
+	for i, id := range serverHalfIDs {
+		if !isZeroServerHalfID(id) {
+			return i, true
+		}
+	}
+	return -1, true
+}
+
+// applyTo returns the devices in before that are left over after
+// removing the devices in info, and all the devices of every user
+// info marks as removed.
+func (info ServerHalfRemovalInfo) applyTo(
+	before UserDevicePublicKeys) UserDevicePublicKeys {
+	remaining := make(UserDevicePublicKeys, len(before))
+	for uid, dpk := range before {
+		userRemovalInfo, ok := info[uid]
+		if ok && userRemovalInfo.UserRemoved {
+			continue
+		}
+		keys := make(DevicePublicKeys, len(dpk))
+		for key, v := range dpk {
+			if !v {
+				continue
+			}
+			if _, removed := userRemovalInfo.DeviceServerHalfIDs[key]; removed {
+				continue
+			}
+			keys[key] = true
+		}
+		remaining[uid] = keys
+	}
+	return remaining
+}
+
+// ValidateRemovalAgainstRosters returns an error if removing the
+// devices in info (and all the devices of every user info marks as
+// removed) from before doesn't yield exactly the devices in after.
+// The error describes the devices that are left over but not in after
+// (extra), and the devices in after that aren't left over (missing).
+func ValidateRemovalAgainstRosters(
+	before, after UserDevicePublicKeys, info ServerHalfRemovalInfo) error {
+	remaining := info.applyTo(before)
+	extra := remaining.difference(after)
+	missing := after.difference(remaining)
+	if len(extra) == 0 && len(missing) == 0 {
+		return nil
+	}
+	return fmt.Errorf(
+		"removal inconsistent with rosters: extra=[%s], missing=[%s]",
+		strings.Join(extra.describeDevices(), "; "),
+		strings.Join(missing.describeDevices(), "; "))
+}
+
+// WithSortedIDs returns a deep copy of info where the server half IDs
+// of each device are sorted by their string form, instead of being in
+// generation order. This is only useful for canonicalization when
+// generation order doesn't matter; callers that rely on the i-th ID
+// belonging to the i-th key generation must not use this.
+func (info ServerHalfRemovalInfo) WithSortedIDs() ServerHalfRemovalInfo {
+	sorted := make(ServerHalfRemovalInfo, len(info))
+	for uid, userRemovalInfo := range info {
+		riCopy := userRemovalInfo.deepCopy()
+		for _, serverHalfIDs := range riCopy.DeviceServerHalfIDs {
+			sortServerHalfIDs(serverHalfIDs)
+		}
+		sorted[uid] = riCopy
+	}
+	return sorted
+}
+
+// PlanEphemeralRotation returns the devices in infos that must be
+// re-split (e.g., with ResplitWithNewEphemeral) because their key
+// infos use the compromised ephemeral key. compromisedIndex is in the
+// same form as TLFCryptKeyInfo.EPubKeyIndex, so a non-negative index
+// refers to a writer ephemeral key, and -1 - i refers to the i-th
+// reader ephemeral key (see GetEphemeralPublicKeyInfoV2).
+func PlanEphemeralRotation(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+	compromisedIndex int) UserDevicePublicKeys {
+	return DevicesUsingEPubKeyIndex(infos, compromisedIndex)
+}
+
+// UserDeviceServerHalfID identifies a single server half ID of a
+// device in a ServerHalfRemovalInfo.
+type UserDeviceServerHalfID = struct {
+	UID keybase1.UID
+	Key kbfscrypto.CryptPublicKey
+	ID  kbfscrypto.TLFCryptKeyServerHalfID
+}
+
+// FindIntraDeviceDuplicateIDs returns the server half IDs that appear
+// more than once in a single device's list in info, sorted by UID,
+// then by key, then by position of the first duplicate. Each
+// duplicated ID is returned once per device. Since each key
+// generation has a distinct server half, any result indicates a bug
+// such as a generation being added twice.
+func (info ServerHalfRemovalInfo) FindIntraDeviceDuplicateIDs() []UserDeviceServerHalfID {
+	var duplicates []UserDeviceServerHalfID
+	for _, uid := range info.sortedUIDs() {
+		deviceServerHalfIDs := info[uid].DeviceServerHalfIDs
+		for _, key := range deviceServerHalfIDs.sortedKeys() {
+			counts := make(map[kbfscrypto.TLFCryptKeyServerHalfID]int)
+			for _, id := range deviceServerHalfIDs[key] {
+				counts[id]++
+				if counts[id] == 2 {
+					duplicates = append(duplicates,
+						UserDeviceServerHalfID{uid, key, id})
+				}
+			}
+		}
+	}
+	return duplicates
+}
+
+// AllUsersSameGenerationCount returns the number of key generations
+// covered for every user in info, where a user's generation count is
+// the maximum number of server half IDs for any of its devices. If
+// the users don't all have the same count, it returns an error naming
+// the first user (in UID order) whose count differs from that of the
+// first user.
+func (info ServerHalfRemovalInfo) AllUsersSameGenerationCount() (int, error) {
+	expected := -1
+	for _, uid := range info.sortedUIDs() {
+		count := ServerHalfRemovalInfo{uid: info[uid]}.GenerationCount()
+		if expected == -1 {
+			expected = count
+		} else if count != expected {
+			return 0, fmt.Errorf(
+				"expected %d generations, got %d for user %s",
+				expected, count, uid)
+		}
+	}
+	if expected == -1 {
+		return 0, nil
+	}
+	return expected, nil
+}
+
+// userDevicePublicKeysEntry is the canonical serialized form of a
+// single user's entry in a UserDevicePublicKeys.
+type userDevicePublicKeysEntry struct {
+	UID  keybase1.UID                `codec:"u"`
+	Keys []kbfscrypto.CryptPublicKey `codec:"k"`
+}
+
+// SerializeCanonical returns a canonical serialization of udpk using
+// the given codec, suitable for signing. Users are sorted by UID, and
+// each user's devices are sorted by the string form of their keys,
+// so rosters that are Equals() produce the same bytes.
+func (udpk UserDevicePublicKeys) SerializeCanonical(
+	codec kbfscodec.Codec) ([]byte, error) {
+	entries := make([]userDevicePublicKeysEntry, 0, len(udpk))
+	for _, uid := range udpk.sortedUIDs() {
+		entries = append(entries, userDevicePublicKeysEntry{
+			UID:  uid,
+			Keys: udpk[uid].sortedKeys(),
+		})
+	}
+	return codec.Encode(entries)
+}
+
+// GenerationsForDevice returns the (increasing) generation indices at
+// which the given device has a non-zero server half ID in info, and
+// whether the device is in info at all. Any index missing from the
+// result is a gap in the device's removal coverage.
+func (info ServerHalfRemovalInfo) GenerationsForDevice(
+	uid keybase1.UID, key kbfscrypto.CryptPublicKey) ([]int, bool) {
+	serverHalfIDs, ok := info[uid].DeviceServerHalfIDs[key]
+	if !ok {
+		return nil, false
+	}
+	var generations []int
+	for i, id := range serverHalfIDs {
+		if !isZeroServerHalfID(id) {
+			generations = append(generations, i)
+		}
+	}
+	return generations, true
+}
+
+// keyInfosEqual returns whether the two key infos are identical.
+func keyInfosEqual(a, b TLFCryptKeyInfo) bool {
+	return a.ServerHalfID == b.ServerHalfID &&
+		a.EPubKeyIndex == b.EPubKeyIndex &&
+		clientHalvesEqual(a.ClientHalf, b.ClientHalf)
+}
+
+// MergeRekeyOutputsStrict merges two rekey outputs, each consisting
+// of key infos and server halves. A device may be in both outputs
+// only if it has identical key infos and server halves in both;
+// otherwise, an error naming the device is returned. Neither output
+// is modified.
+func MergeRekeyOutputsStrict(infosA,
+	infosB map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+	halvesA, halvesB UserDeviceKeyServerHalves) (
+	map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+	UserDeviceKeyServerHalves, error) {
+	publicKeysA := keyInfosToPublicKeys(infosA)
+	for _, uid := range publicKeysA.sortedUIDs() {
+		for _, key := range publicKeysA[uid].sortedKeys() {
+			infoB, ok := infosB[uid][key]
+			if ok && !keyInfosEqual(infosA[uid][key], infoB) {
+				return nil, nil, fmt.Errorf(
+					"conflicting key infos for user %s and device %s",
+					uid, key)
+			}
+		}
+	}
+
+	halves, err := halvesA.MergeStrict(halvesB)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return MergeKeyInfos(infosA, infosB), halves, nil
+}
+
+// DistinctEPubKeyIndicesAcross returns the set of ephemeral key
+// indices referenced by any key info in any element of perGen.
+func DistinctEPubKeyIndicesAcross(
+	perGen []map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo) map[int]bool {
+	indices := make(map[int]bool)
+	for _, infos := range perGen {
+		for _, deviceInfos := range infos {
+			for _, info := range deviceInfos {
+				indices[info.EPubKeyIndex] = true
+			}
+		}
+	}
+	return indices
+}
+
+// CoversDevices returns whether every device in removed is in info.
+// If not, it also returns the devices in removed that aren't.
+func (info ServerHalfRemovalInfo) CoversDevices(
+	removed UserDevicePublicKeys) (bool, UserDevicePublicKeys) {
+	uncovered := removed.difference(info.TouchedDevices())
+	if len(uncovered) == 0 {
+		return true, nil
+	}
+	return false, uncovered
+}
+
+// ChunkKeyInfos splits infos into maps with at most maxDevices
+// devices each, filled in order of UID and then key, so a user's
+// devices may be split across consecutive chunks. The union of the
+// chunks is infos. It returns nil if maxDevices isn't positive.
+func ChunkKeyInfos(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+	maxDevices int) []map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo {
+	if maxDevices <= 0 {
+		return nil
+	}
+
+	var chunks []map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo
+	var chunk map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo
+	chunkDevices := 0
+	publicKeys := keyInfosToPublicKeys(infos)
+	for _, uid := range publicKeys.sortedUIDs() {
+		for _, key := range publicKeys[uid].sortedKeys() {
+			if chunk == nil || chunkDevices == maxDevices {
+				chunk = make(map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo)
+				chunks = append(chunks, chunk)
+				chunkDevices = 0
+			}
+			if chunk[uid] == nil {
+				chunk[uid] = make(map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo)
+			}
+			chunk[uid][key] = infos[uid][key]
+			chunkDevices++
+		}
+	}
+	return chunks
+}
+
+// ReconcileWithDeleted compares the server half IDs in info with the
+// IDs that were actually deleted. It returns the planned IDs that
+// weren't deleted (missing) and the deleted IDs that weren't planned
+// (extra), both sorted by their string form.
+func (info ServerHalfRemovalInfo) ReconcileWithDeleted(
+	deleted map[kbfscrypto.TLFCryptKeyServerHalfID]bool) (
+	missing []kbfscrypto.TLFCryptKeyServerHalfID,
+	extra []kbfscrypto.TLFCryptKeyServerHalfID) {
+	planned := make(map[kbfscrypto.TLFCryptKeyServerHalfID]bool)
+	for _, userRemovalInfo := range info {
+		for _, id := range userRemovalInfo.DeviceServerHalfIDs.AllIDs() {
+			if planned[id] {
+				continue
+			}
+			planned[id] = true
+			if !deleted[id] {
+				missing = append(missing, id)
+			}
+		}
+	}
+	for id, v := range deleted {
+		if v && !planned[id] {
+			extra = append(extra, id)
+		}
+	}
+	return sortServerHalfIDs(missing), sortServerHalfIDs(extra)
+}
+
+// IsEmpty returns whether info has no server half IDs at all, in
+// which case removing it would be a no-op.
+func (info ServerHalfRemovalInfo) IsEmpty() bool {
+	for _, userRemovalInfo := range info {
+		for _, serverHalfIDs := range userRemovalInfo.DeviceServerHalfIDs {
+			if len(serverHalfIDs) > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// RekeyGap splits the devices in target into those that have a
+// server half in halves (covered) and those that don't (missing).
+// Users with no devices on one side are omitted from it.
+func RekeyGap(target UserDevicePublicKeys,
+	halves UserDeviceKeyServerHalves) (covered, missing UserDevicePublicKeys) {
+	halvesPublicKeys := halves.toPublicKeys()
+	return target.Intersection(halvesPublicKeys),
+		target.difference(halvesPublicKeys)
+}
+
+// AssembleServerHalfRemovalInfo returns a deep copy of the given
+// per-user removal infos, combined into a single
+// ServerHalfRemovalInfo. It returns an error if any user has a nil
+// device map, or if a user's devices don't all have the same number
+// of server half IDs.
+func AssembleServerHalfRemovalInfo(
+	perUser map[keybase1.UID]UserServerHalfRemovalInfo) (
+	ServerHalfRemovalInfo, error) {
+	assembled := make(ServerHalfRemovalInfo, len(perUser))
+	for uid, userRemovalInfo := range perUser {
+		deviceServerHalfIDs := userRemovalInfo.DeviceServerHalfIDs
+		if deviceServerHalfIDs == nil {
+			return nil, fmt.Errorf(
+				"nil device server half IDs for user %s", uid)
+		}
+		idCount := -1
+		for _, key := range deviceServerHalfIDs.sortedKeys() {
+			localIDCount := len(deviceServerHalfIDs[key])
+			if idCount == -1 {
+				idCount = localIDCount
+			} else if localIDCount != idCount {
+				return nil, fmt.Errorf(
+					"expected %d keys, got %d for user %s and device %s",
+					idCount, localIDCount, uid, key)
+			}
+		}
+		assembled[uid] = userRemovalInfo.deepCopy()
+	}
+	return assembled, nil
+}
+
+// CommonEPubKeyIndices returns the set of ephemeral key indices that
+// are referenced by key infos in both a and b.
+func CommonEPubKeyIndices(
+	a, b map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo) map[int]bool {
+	aIndices := DistinctEPubKeyIndicesAcross(
+		[]map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{a})
+	bIndices := DistinctEPubKeyIndicesAcross(
+		[]map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{b})
+	common := make(map[int]bool)
+	for index := range aIndices {
+		if bIndices[index] {
+			common[index] = true
+		}
+	}
+	return common
+}
+
+// ExtraDevicesInOutput returns the devices that have key infos in
+// infos but aren't in intended. An empty result means that infos
+// doesn't key any unintended devices.
+func ExtraDevicesInOutput(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+	intended UserDevicePublicKeys) UserDevicePublicKeys {
+	return keyInfosToPublicKeys(infos).difference(intended)
+}
+
+// WouldLeaveNoWriters returns whether applying info to
+// currentWriters would leave no writer devices at all, which would
+// make the TLF permanently unwritable. Users in info that aren't
+// writers are ignored, but it returns an error if info removes a
+// device that a writer doesn't have, since that means info wasn't
+// computed from currentWriters.
+func (info ServerHalfRemovalInfo) WouldLeaveNoWriters(
+	currentWriters UserDevicePublicKeys) (bool, error) {
+	for _, uid := range info.sortedUIDs() {
+		writerKeys, ok := currentWriters[uid]
+		if !ok {
+			continue
+		}
+		for _, key := range info[uid].DeviceServerHalfIDs.sortedKeys() {
+			if !writerKeys[key] {
+				return false, fmt.Errorf(
+					"writer %s doesn't have removed device %s",
+					uid, key)
+			}
+		}
+	}
+
+	for _, keys := range info.applyTo(currentWriters) {
+		if len(keys) > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Hash returns the default (SHA-256) hash of the canonical
+// serialization of info using the given codec (see SignatureInput),
+// so plans with equal canonical forms have equal hashes. This is
+// useful to deduplicate removal plans.
+func (info ServerHalfRemovalInfo) Hash(
+	codec kbfscodec.Codec) (kbfshash.Hash, error) {
+	buf, err := info.SignatureInput(codec)
+	if err != nil {
+		return kbfshash.Hash{}, err
+	}
+	return kbfshash.DefaultHash(buf)
+}
+
+// SuggestEPubKeyIndexForDevice returns the ephemeral key index used
+// by the most of the given user's existing devices in infos (breaking
+// ties by the smallest index), so that a new device for that user can
+// reuse it. It returns false if the user has no devices in infos.
+func SuggestEPubKeyIndexForDevice(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+	uid keybase1.UID) (int, bool) {
+	index, count := DominantEPubKeyIndex(
+		map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+			uid: infos[uid],
+		})
+	if count == 0 {
+		return 0, false
+	}
+	return index, true
+}
+
+// SplitByGeneration returns one ServerHalfRemovalInfo per generation
+// index in info, each with every user in info and, for each device,
+// only the server half ID at that index. Devices with no ID at an
+// index are omitted from that generation's plan. For a plan where
+// every device has the same number of IDs, this is the inverse of
+// UnionServerHalfRemovalInfos.
+func (info ServerHalfRemovalInfo) SplitByGeneration() []ServerHalfRemovalInfo {
+	generationCount := info.GenerationCount()
+	perGen := make([]ServerHalfRemovalInfo, generationCount)
+	for i := range perGen {
+		genInfo := make(ServerHalfRemovalInfo, len(info))
+		for uid, userRemovalInfo := range info {
+			deviceServerHalfIDs := make(DeviceServerHalfRemovalInfo,
+				len(userRemovalInfo.DeviceServerHalfIDs))
+			for key, serverHalfIDs := range userRemovalInfo.DeviceServerHalfIDs {
+				if i < len(serverHalfIDs) {
+					deviceServerHalfIDs[key] =
+						[]kbfscrypto.TLFCryptKeyServerHalfID{serverHalfIDs[i]}
+				}
+			}
+			genInfo[uid] = UserServerHalfRemovalInfo{
+				UserRemoved:         userRemovalInfo.UserRemoved,
+				DeviceServerHalfIDs: deviceServerHalfIDs,
+			}
+		}
+		perGen[i] = genInfo
+	}
+	return perGen
+}
+
+// validateEPubKeyIndexSigns returns an error for the first device (in
+// order of UID and then key) in infos whose EPubKeyIndex has the
+// wrong sign: devices in negative must have negative indices, and
+// all other devices must have non-negative ones. negativeName and
+// nonNegativeName describe the two kinds of devices in errors.
+func validateEPubKeyIndexSigns(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+	negative UserDevicePublicKeys,
+	negativeName, nonNegativeName string) error {
+	publicKeys := keyInfosToPublicKeys(infos)
+	for _, uid := range publicKeys.sortedUIDs() {
+		for _, key := range publicKeys[uid].sortedKeys() {
+			index := infos[uid][key].EPubKeyIndex
+			isNegative := negative[uid][key]
+			if isNegative && index >= 0 {
+				return fmt.Errorf(
+					"%s device %s for user %s has non-negative "+
+						"EPubKeyIndex=%d", negativeName, key, uid, index)
+			} else if !isNegative && index < 0 {
+				return fmt.Errorf(
+					"%s device %s for user %s has negative "+
+						"EPubKeyIndex=%d", nonNegativeName, key, uid, index)
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateEPubKeyIndexSigns returns an error for the first device (in
+// order of UID and then key) in infos whose EPubKeyIndex has the
+// wrong sign, for a bundle where reader devices must use reader
+// ephemeral keys (negative indices) and writer devices must use
+// writer ephemeral keys (non-negative indices). That only holds for
+// V2 bundles whose readers were all keyed by reader rekeys; see
+// ValidateV2EPubKeyIndexSigns for V2 bundles in general.
+func ValidateEPubKeyIndexSigns(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+	readers UserDevicePublicKeys) error {
+	return validateEPubKeyIndexSigns(infos, readers, "reader", "writer")
+}
+
+// ValidateV2EPubKeyIndexSigns is like ValidateEPubKeyIndexSigns, but
+// for any V2 bundle. In V2, only a reader rekey uses reader ephemeral
+// keys; a writer rekey keys readers with writer ephemeral keys, like
+// writers. So devices in readerRekeyed, which must be exactly the
+// devices last keyed by a reader rekey, must have negative indices,
+// and all other devices, readers included, must have non-negative
+// ones. Neither function applies to V3, which doesn't use negative
+// indices.
+func ValidateV2EPubKeyIndexSigns(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+	readerRekeyed UserDevicePublicKeys) error {
+	return validateEPubKeyIndexSigns(
+		infos, readerRekeyed, "reader-rekeyed", "writer-rekeyed")
+}
+
+// DevicesToResplitForUser returns the given user's devices whose key
+// infos in infos use the ephemeral key with the given index, which
+// is in the same form as TLFCryptKeyInfo.EPubKeyIndex.
+func DevicesToResplitForUser(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+	uid keybase1.UID, index int) DevicePublicKeys {
+	devices := make(DevicePublicKeys)
+	for key, info := range infos[uid] {
+		if info.EPubKeyIndex == index {
+			devices[key] = true
+		}
+	}
+	return devices
+}
+
+// ValidateKeyBundleData runs several integrity checks on the key
+// data of a loaded bundle, and returns an error describing every
+// problem found, or nil if there are none. It checks that infos and
+// halves cover the same devices, that every non-negative
+// EPubKeyIndex is less than numWriterEPubKeys, that every negative
+// one (after undoing the encoding used for reader ephemeral keys) is
+// less than numReaderEPubKeys, that no server half is zero, and that
+// no server half ID is used by more than one device.
+func ValidateKeyBundleData(
+	infos map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo,
+	halves UserDeviceKeyServerHalves,
+	numWriterEPubKeys, numReaderEPubKeys int) error {
+	var errs []error
+
+	if ok, diff := DeviceSetsAgree(infos, halves); !ok {
+		errs = append(errs, fmt.Errorf(
+			"key infos and server halves differ for devices [%s]",
+			strings.Join(diff.describeDevices(), "; ")))
+	}
+
+	publicKeys := keyInfosToPublicKeys(infos)
+	for _, uid := range publicKeys.sortedUIDs() {
+		for _, key := range publicKeys[uid].sortedKeys() {
+			encodedIndex := infos[uid][key].EPubKeyIndex
+			if encodedIndex >= 0 {
+				if encodedIndex >= numWriterEPubKeys {
+					errs = append(errs, fmt.Errorf(
+						"writer EPubKeyIndex=%d >= %d "+
+							"for user %s and device %s",
+						encodedIndex, numWriterEPubKeys, uid, key))
+				}
+				continue
+			}
+			// Report the index into the reader ephemeral key
+			// list, as well as the encoded one.
+			index := -1 - encodedIndex
+			if index >= numReaderEPubKeys {
+				errs = append(errs, fmt.Errorf(
+					"reader EPubKeyIndex=%d (index %d) >= %d "+
+						"for user %s and device %s",
+					encodedIndex, index, numReaderEPubKeys, uid, key))
+			}
+		}
+	}
+
+	halvesPublicKeys := halves.toPublicKeys()
+	for _, uid := range halvesPublicKeys.sortedUIDs() {
+		for _, key := range halvesPublicKeys[uid].sortedKeys() {
+			if halves[uid][key] == (kbfscrypto.TLFCryptKeyServerHalf{}) {
+				errs = append(errs, fmt.Errorf(
+					"zero server half for user %s and device %s",
+					uid, key))
+			}
+		}
+	}
+
+	duplicates := FindDuplicateServerHalfIDs(infos)
+	duplicateIDs := make([]kbfscrypto.TLFCryptKeyServerHalfID, 0,
+		len(duplicates))
+	for id := range duplicates {
+		duplicateIDs = append(duplicateIDs, id)
+	}
+	for _, id := range sortServerHalfIDs(duplicateIDs) {
+		errs = append(errs, fmt.Errorf(
+			"server half ID %s is used by %d devices",
+			id, len(duplicates[id])))
+	}
+
+	return libkb.CombineErrors(errs...)
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/keybase/go-codec/codec"
 	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -339,3 +340,3588 @@ func TestServerHalfRemovalInfoMergeUsers(t *testing.T) {
 		uid4: userRemovalInfo,
 	}, info3)
 }
+
+func makeTestServerHalfID(t *testing.T, uid keybase1.UID,
+	key kbfscrypto.CryptPublicKey, b byte) kbfscrypto.TLFCryptKeyServerHalfID {
+	serverHalf := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{b})
+	id, err := kbfscrypto.MakeTLFCryptKeyServerHalfID(uid, key, serverHalf)
+	require.NoError(t, err)
+	return id
+}
+
+func TestServerHalfRemovalInfoCanonical(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+	uid3 := keybase1.MakeTestUID(0x3)
+	uid4 := keybase1.MakeTestUID(0x4)
+	uid5 := keybase1.MakeTestUID(0x5)
+
+	id1a := makeTestServerHalfID(t, uid1, key1, 0x1)
+	id1b := makeTestServerHalfID(t, uid1, key1, 0x2)
+
+	messy := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: make([]kbfscrypto.TLFCryptKeyServerHalfID, 2, 10),
+				key2: {},
+			},
+		},
+		uid2: UserServerHalfRemovalInfo{},
+		uid3: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key2: nil,
+			},
+		},
+		// Removed users with no devices, as produced by
+		// RemoveDevicesNotIn, must be kept.
+		uid4: UserServerHalfRemovalInfo{
+			UserRemoved:         true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{},
+		},
+		uid5: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: nil,
+			},
+		},
+	}
+	messy[uid1].DeviceServerHalfIDs[key1][0] = id1a
+	messy[uid1].DeviceServerHalfIDs[key1][1] = id1b
+
+	clean := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {id1a, id1b},
+			},
+		},
+		uid4: UserServerHalfRemovalInfo{
+			UserRemoved:         true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{},
+		},
+		uid5: UserServerHalfRemovalInfo{
+			UserRemoved:         true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{},
+		},
+	}
+
+	require.Equal(t, clean.Canonical(), messy.Canonical())
+	require.Equal(t, clean, messy.Canonical())
+
+	codec := kbfscodec.NewMsgpack()
+	messyBuf, err := codec.Encode(messy.Canonical())
+	require.NoError(t, err)
+	cleanBuf, err := codec.Encode(clean.Canonical())
+	require.NoError(t, err)
+	require.Equal(t, cleanBuf, messyBuf)
+
+	// The copy must not share slices with the original.
+	canonical := clean.Canonical()
+	canonical[uid1].DeviceServerHalfIDs[key1][0] = id1b
+	require.Equal(t, id1a, clean[uid1].DeviceServerHalfIDs[key1][0])
+
+	require.Equal(t, ServerHalfRemovalInfo{},
+		ServerHalfRemovalInfo(nil).Canonical())
+}
+
+func TestOrphanedEPubKeyIndices(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	remaining := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 0},
+		},
+		uid2: {
+			key2: TLFCryptKeyInfo{EPubKeyIndex: 0},
+		},
+	}
+
+	require.Equal(t, []int{1},
+		OrphanedEPubKeyIndices(remaining, []int{0, 1}))
+	require.Nil(t, OrphanedEPubKeyIndices(remaining, []int{0}))
+}
+
+func TestServerHalfRemovalInfoTouchedDevices(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	info := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {makeTestServerHalfID(t, uid1, key1, 0x1)},
+				key2: {makeTestServerHalfID(t, uid1, key2, 0x2)},
+			},
+		},
+		uid2: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key3: {makeTestServerHalfID(t, uid2, key3, 0x3)},
+			},
+		},
+	}
+
+	expected := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true},
+		uid2: DevicePublicKeys{key3: true},
+	}
+	touched := info.TouchedDevices()
+	require.True(t, expected.Equals(touched), "touched=%v", touched)
+}
+
+func TestDeviceSetsAgree(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	half := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x1})
+
+	infos := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{},
+			key2: TLFCryptKeyInfo{},
+		},
+		uid2: {},
+	}
+	halves := UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{
+			key1: half,
+			key2: half,
+		},
+	}
+
+	agree, diff := DeviceSetsAgree(infos, halves)
+	require.True(t, agree)
+	require.Nil(t, diff)
+
+	infos[uid2] = map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		key3: {},
+	}
+	delete(halves[uid1], key2)
+	halves[uid1][key3] = half
+
+	agree, diff = DeviceSetsAgree(infos, halves)
+	require.False(t, agree)
+	expectedDiff := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key2: true, key3: true},
+		uid2: DevicePublicKeys{key3: true},
+	}
+	require.True(t, expectedDiff.Equals(diff), "diff=%v", diff)
+}
+
+func TestUserDeviceKeyServerHalvesCountsByUser(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+	uid3 := keybase1.MakeTestUID(0x3)
+
+	half := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x1})
+
+	serverHalves := UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{
+			key1: half,
+			key2: half,
+		},
+		uid2: DeviceKeyServerHalves{
+			key1: half,
+		},
+		uid3: DeviceKeyServerHalves{},
+	}
+
+	require.Equal(t, map[keybase1.UID]int{
+		uid1: 2,
+		uid2: 1,
+		uid3: 0,
+	}, serverHalves.CountsByUser())
+}
+
+func TestComputeServerHalfRemovalInfo(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	ids := map[keybase1.UID]map[kbfscrypto.CryptPublicKey][]kbfscrypto.TLFCryptKeyServerHalfID{
+		uid1: {
+			key1: {
+				makeTestServerHalfID(t, uid1, key1, 0x1),
+				makeTestServerHalfID(t, uid1, key1, 0x2),
+			},
+			key2: {
+				makeTestServerHalfID(t, uid1, key2, 0x3),
+				makeTestServerHalfID(t, uid1, key2, 0x4),
+			},
+		},
+		uid2: {
+			key3: {
+				makeTestServerHalfID(t, uid2, key3, 0x5),
+				makeTestServerHalfID(t, uid2, key3, 0x6),
+			},
+		},
+	}
+	idLookup := func(uid keybase1.UID, key kbfscrypto.CryptPublicKey) (
+		[]kbfscrypto.TLFCryptKeyServerHalfID, error) {
+		return ids[uid][key], nil
+	}
+
+	before := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true},
+		uid2: DevicePublicKeys{key3: true},
+	}
+
+	// Remove uid2 entirely.
+	after := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true},
+	}
+	info, err := ComputeServerHalfRemovalInfo(before, after, idLookup)
+	require.NoError(t, err)
+	require.Equal(t, ServerHalfRemovalInfo{
+		uid2: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key3: ids[uid2][key3],
+			},
+		},
+	}, info)
+
+	// Remove a single device of uid1.
+	after = UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true},
+		uid2: DevicePublicKeys{key3: true},
+	}
+	info, err = ComputeServerHalfRemovalInfo(before, after, idLookup)
+	require.NoError(t, err)
+	require.Equal(t, ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			UserRemoved: false,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key2: ids[uid1][key2],
+			},
+		},
+	}, info)
+
+	// A lookup with no IDs is an error.
+	_, err = ComputeServerHalfRemovalInfo(before, after,
+		func(keybase1.UID, kbfscrypto.CryptPublicKey) (
+			[]kbfscrypto.TLFCryptKeyServerHalfID, error) {
+			return nil, nil
+		})
+	require.Error(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "no server half IDs"),
+		"err=%v", err)
+}
+
+func TestKeyInfosEqualIgnoringIDs(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+
+	makeInfos := func(idByte byte, data string) map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo {
+		return map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+			uid1: {
+				key1: TLFCryptKeyInfo{
+					ClientHalf: kbfscrypto.MakeEncryptedTLFCryptKeyClientHalfForTest(
+						kbfscrypto.EncryptionSecretbox,
+						[]byte(data), []byte("fake nonce")),
+					ServerHalfID: makeTestServerHalfID(
+						t, uid1, key1, idByte),
+					EPubKeyIndex: 1,
+				},
+				key2: TLFCryptKeyInfo{
+					ClientHalf: kbfscrypto.MakeEncryptedTLFCryptKeyClientHalfForTest(
+						kbfscrypto.EncryptionSecretbox,
+						[]byte("other data"), []byte("fake nonce")),
+					ServerHalfID: makeTestServerHalfID(
+						t, uid1, key2, idByte),
+				},
+			},
+		}
+	}
+
+	a := makeInfos(0x1, "fake data")
+	b := makeInfos(0x2, "fake data")
+	require.NotEqual(t,
+		a[uid1][key1].ServerHalfID, b[uid1][key1].ServerHalfID)
+	require.True(t, KeyInfosEqualIgnoringIDs(a, b))
+
+	c := makeInfos(0x1, "different data")
+	require.False(t, KeyInfosEqualIgnoringIDs(a, c))
+
+	delete(c[uid1], key1)
+	require.False(t, KeyInfosEqualIgnoringIDs(a, c))
+}
+
+func TestServerHalfRemovalInfoShardByUser(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+
+	info := make(ServerHalfRemovalInfo)
+	for i := byte(1); i <= 10; i++ {
+		uid := keybase1.MakeTestUID(uint32(i))
+		info[uid] = UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {makeTestServerHalfID(t, uid, key1, i)},
+			},
+		}
+	}
+
+	shards := info.ShardByUser(3)
+	require.Len(t, shards, 3)
+
+	union := make(ServerHalfRemovalInfo)
+	for _, shard := range shards {
+		var err error
+		union, err = union.MergeUsers(shard)
+		require.NoError(t, err)
+	}
+	require.Equal(t, info, union)
+
+	for i := 0; i < 5; i++ {
+		require.Equal(t, shards, info.ShardByUser(3))
+	}
+
+	require.Nil(t, info.ShardByUser(0))
+}
+
+func TestUserDevicePublicKeysOwnerOf(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	udpk := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true},
+		uid2: DevicePublicKeys{key2: true},
+	}
+
+	uid, ok := udpk.OwnerOf(key2)
+	require.True(t, ok)
+	require.Equal(t, uid2, uid)
+
+	_, ok = udpk.OwnerOf(key3)
+	require.False(t, ok)
+}
+
+func TestServerHalfRemovalInfoMergePreferringLonger(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	id1a := makeTestServerHalfID(t, uid1, key1, 0x1)
+	id1b := makeTestServerHalfID(t, uid1, key1, 0x2)
+	id1c := makeTestServerHalfID(t, uid1, key1, 0x3)
+	id2a := makeTestServerHalfID(t, uid1, key2, 0x4)
+	id2b := makeTestServerHalfID(t, uid1, key2, 0x5)
+	id2c := makeTestServerHalfID(t, uid1, key2, 0x6)
+	id3a := makeTestServerHalfID(t, uid2, key1, 0x7)
+
+	info1 := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {id1a},
+				key2: {id2a, id2b},
+			},
+		},
+	}
+	info2 := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				// Has info1's IDs as a prefix.
+				key1: {id1a, id1b},
+				// Conflicts with info1's IDs.
+				key2: {id2c, id2a, id2b},
+			},
+		},
+		uid2: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {id3a},
+			},
+		},
+	}
+
+	merged := info1.MergePreferringLonger(info2)
+	require.Equal(t, ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {id1a, id1b},
+				key2: {id2a, id2b},
+			},
+		},
+		uid2: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {id3a},
+			},
+		},
+	}, merged)
+
+	// The receiver shouldn't be modified.
+	require.Equal(t, []kbfscrypto.TLFCryptKeyServerHalfID{id1a},
+		info1[uid1].DeviceServerHalfIDs[key1])
+
+	// A non-prefix shorter list loses to the receiver's longer one.
+	info3 := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {id1c},
+			},
+		},
+	}
+	merged = info2.MergePreferringLonger(info3)
+	require.Equal(t, []kbfscrypto.TLFCryptKeyServerHalfID{id1a, id1b},
+		merged[uid1].DeviceServerHalfIDs[key1])
+}
+
+func TestDeviceServerHalfRemovalInfoAllIDs(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid := keybase1.MakeTestUID(0x1)
+
+	d := DeviceServerHalfRemovalInfo{
+		key1: {
+			makeTestServerHalfID(t, uid, key1, 0x1),
+			makeTestServerHalfID(t, uid, key1, 0x2),
+		},
+		key2: {
+			makeTestServerHalfID(t, uid, key2, 0x3),
+		},
+		key3: {
+			makeTestServerHalfID(t, uid, key3, 0x4),
+			makeTestServerHalfID(t, uid, key3, 0x5),
+			makeTestServerHalfID(t, uid, key3, 0x6),
+		},
+	}
+
+	ids := d.AllIDs()
+	require.Len(t, ids, len(d[key1])+len(d[key2])+len(d[key3]))
+	for i := 0; i < 5; i++ {
+		require.Equal(t, ids, d.AllIDs())
+	}
+}
+
+func TestRekeyOutputIsEmpty(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+
+	require.True(t, RekeyOutputIsEmpty(nil, nil))
+
+	infos := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {},
+	}
+	halves := UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{},
+	}
+	require.True(t, RekeyOutputIsEmpty(infos, halves))
+
+	infos[uid1][key1] = TLFCryptKeyInfo{}
+	halves[uid1][key1] = kbfscrypto.MakeTLFCryptKeyServerHalf(
+		[32]byte{0x1})
+	require.False(t, RekeyOutputIsEmpty(infos, halves))
+}
+
+func TestUserDeviceKeyServerHalvesReconcile(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+
+	half1 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x1})
+	half2 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x2})
+
+	serverHalves := UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{
+			key1: half1,
+			key2: half2,
+		},
+	}
+
+	// key1's half is in both, key2's is only local, and key3's
+	// is only on the server.
+	id1 := makeTestServerHalfID(t, uid1, key1, 0x1)
+	id3 := makeTestServerHalfID(t, uid1, key3, 0x3)
+	serverIDs := map[kbfscrypto.TLFCryptKeyServerHalfID]bool{
+		id1: true,
+		id3: true,
+	}
+
+	toUpload, toDelete, err := serverHalves.Reconcile(serverIDs)
+	require.NoError(t, err)
+	require.Equal(t, UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{
+			key2: half2,
+		},
+	}, toUpload)
+	require.Equal(t, []kbfscrypto.TLFCryptKeyServerHalfID{id3}, toDelete)
+}
+
+func TestServerHalfRemovalInfoGenerationCount(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+
+	id1a := makeTestServerHalfID(t, uid1, key1, 0x1)
+	id1b := makeTestServerHalfID(t, uid1, key1, 0x2)
+	id1c := makeTestServerHalfID(t, uid1, key1, 0x3)
+	id2a := makeTestServerHalfID(t, uid1, key2, 0x4)
+	id2b := makeTestServerHalfID(t, uid1, key2, 0x5)
+
+	require.Equal(t, 0, ServerHalfRemovalInfo{}.GenerationCount())
+
+	info := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {id1a, id1b},
+				key2: {id2a, id2b},
+			},
+		},
+	}
+	require.Equal(t, 2, info.GenerationCount())
+
+	info[uid1].DeviceServerHalfIDs[key1] = append(
+		info[uid1].DeviceServerHalfIDs[key1], id1c)
+	require.Equal(t, 3, info.GenerationCount())
+}
+
+func TestRekeyOutputSummary(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+	uid3 := keybase1.MakeTestUID(0x3)
+
+	half := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x1})
+
+	infos := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{},
+			key2: TLFCryptKeyInfo{},
+		},
+		uid2: {
+			key3: TLFCryptKeyInfo{},
+		},
+		uid3: {},
+	}
+	halves := UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{
+			key1: half,
+			key2: half,
+		},
+		uid2: DeviceKeyServerHalves{
+			key3: half,
+		},
+	}
+
+	require.Equal(t, "rekeyed 2 users / 3 devices; 3 server halves",
+		RekeyOutputSummary(infos, halves))
+}
+
+func TestDevicePublicKeysHasZeroKey(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+
+	dpk := DevicePublicKeys{key1: true}
+	hasZeroKey, err := dpk.HasZeroKey()
+	require.NoError(t, err)
+	require.False(t, hasZeroKey)
+
+	dpk[kbfscrypto.CryptPublicKey{}] = true
+	hasZeroKey, err = dpk.HasZeroKey()
+	require.NoError(t, err)
+	require.True(t, hasZeroKey)
+
+	// A well-formed DH KID with all-zero key bytes.
+	zeroKey := kbfscrypto.MakeCryptPublicKey(
+		keybase1.KID("0121" + strings.Repeat("00", 32) + "0a"))
+	dpk = DevicePublicKeys{key1: true, zeroKey: true}
+	hasZeroKey, err = dpk.HasZeroKey()
+	require.NoError(t, err)
+	require.True(t, hasZeroKey)
+
+	// Malformed KIDs aren't reported as zero keys.
+	for _, kid := range []keybase1.KID{"not hex", "0121", "01210a"} {
+		malformedKey := kbfscrypto.MakeCryptPublicKey(kid)
+		dpk = DevicePublicKeys{key1: true, malformedKey: true}
+		hasZeroKey, err = dpk.HasZeroKey()
+		require.Equal(t, fmt.Sprintf("malformed KID %s", kid), err.Error())
+		require.False(t, hasZeroKey)
+	}
+}
+
+func TestUserDeviceKeyServerHalvesMergeStrict(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	half1 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x1})
+	half2 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x2})
+
+	serverHalves1 := UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{
+			key1: half1,
+		},
+	}
+	serverHalves2 := UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{
+			key1: half1,
+			key2: half2,
+		},
+		uid2: DeviceKeyServerHalves{
+			key1: half2,
+		},
+	}
+
+	merged, err := serverHalves1.MergeStrict(serverHalves2)
+	require.NoError(t, err)
+	require.Equal(t, serverHalves2, merged)
+
+	serverHalves2[uid1][key1] = half2
+	_, err = serverHalves1.MergeStrict(serverHalves2)
+	require.Error(t, err)
+	require.Equal(t, fmt.Sprintf(
+		"conflicting server halves for user %s and device %s",
+		uid1, key1), err.Error())
+}
+
+func TestDominantEPubKeyIndex(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	index, count := DominantEPubKeyIndex(nil)
+	require.Equal(t, 0, index)
+	require.Equal(t, 0, count)
+
+	infos := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 2},
+			key2: TLFCryptKeyInfo{EPubKeyIndex: 0},
+		},
+		uid2: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 2},
+			key3: TLFCryptKeyInfo{EPubKeyIndex: 1},
+		},
+	}
+	index, count = DominantEPubKeyIndex(infos)
+	require.Equal(t, 2, index)
+	require.Equal(t, 2, count)
+
+	// Ties go to the smallest index.
+	infos[uid2][key3] = TLFCryptKeyInfo{EPubKeyIndex: 0}
+	index, count = DominantEPubKeyIndex(infos)
+	require.Equal(t, 0, index)
+	require.Equal(t, 2, count)
+}
+
+func TestServerHalfRemovalInfoCoversGenerations(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+
+	info := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {
+					makeTestServerHalfID(t, uid1, key1, 0x1),
+					makeTestServerHalfID(t, uid1, key1, 0x2),
+				},
+				key2: {
+					makeTestServerHalfID(t, uid1, key2, 0x3),
+				},
+			},
+		},
+	}
+
+	covers, offending := info.CoversGenerations(1)
+	require.False(t, covers)
+	require.Equal(t, []string{fmt.Sprintf(
+		"user %s, device %s: expected 1 IDs, got 2", uid1, key1)},
+		offending)
+
+	covers, offending = info.CoversGenerations(2)
+	require.False(t, covers)
+	require.Equal(t, []string{fmt.Sprintf(
+		"user %s, device %s: expected 2 IDs, got 1", uid1, key2)},
+		offending)
+
+	info[uid1].DeviceServerHalfIDs[key2] = append(
+		info[uid1].DeviceServerHalfIDs[key2],
+		makeTestServerHalfID(t, uid1, key2, 0x4))
+	covers, offending = info.CoversGenerations(2)
+	require.True(t, covers)
+	require.Nil(t, offending)
+}
+
+func TestUserDeviceKeyServerHalvesToRemovalTemplate(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	half := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x1})
+
+	serverHalves := UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{
+			key1: half,
+			key2: half,
+		},
+		uid2: DeviceKeyServerHalves{
+			key1: half,
+		},
+	}
+
+	template := serverHalves.ToRemovalTemplate(
+		map[keybase1.UID]bool{uid2: true})
+	require.Equal(t, ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			UserRemoved: false,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {},
+				key2: {},
+			},
+		},
+		uid2: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {},
+			},
+		},
+	}, template)
+}
+
+func TestUserDeviceKeyServerHalvesFindDuplicateHalves(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	half1 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x1})
+	half2 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x2})
+	half3 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x3})
+
+	serverHalves := UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{
+			key1: half1,
+			key2: half2,
+		},
+		uid2: DeviceKeyServerHalves{
+			key1: half3,
+		},
+	}
+	require.Empty(t, serverHalves.FindDuplicateHalves())
+
+	serverHalves[uid2][key1] = half1
+	require.Equal(t, [][]UserDevice{
+		{{uid1, key1}, {uid2, key1}},
+	}, serverHalves.FindDuplicateHalves())
+}
+
+func TestComputeServerHalfRemovalInfoCached(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+
+	before := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true},
+	}
+	after := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true},
+	}
+
+	idCache := map[keybase1.UID]map[kbfscrypto.CryptPublicKey][]kbfscrypto.TLFCryptKeyServerHalfID{
+		uid1: {
+			key1: {makeTestServerHalfID(t, uid1, key1, 0x1)},
+		},
+	}
+
+	_, err := ComputeServerHalfRemovalInfoCached(before, after, idCache)
+	require.Error(t, err)
+	require.True(t, strings.HasPrefix(err.Error(),
+		"no cached server half IDs"), "err=%v", err)
+
+	idCache[uid1][key2] = []kbfscrypto.TLFCryptKeyServerHalfID{
+		makeTestServerHalfID(t, uid1, key2, 0x2),
+	}
+	info, err := ComputeServerHalfRemovalInfoCached(before, after, idCache)
+	require.NoError(t, err)
+	require.Equal(t, ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key2: idCache[uid1][key2],
+			},
+		},
+	}, info)
+}
+
+func TestUserDeviceKeyServerHalvesForEachSorted(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	keys := sortCryptPublicKeys([]kbfscrypto.CryptPublicKey{key1, key2})
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	half1 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x1})
+	half2 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x2})
+	half3 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x3})
+
+	serverHalves := UserDeviceKeyServerHalves{
+		uid2: DeviceKeyServerHalves{
+			key1: half3,
+		},
+		uid1: DeviceKeyServerHalves{
+			keys[1]: half2,
+			keys[0]: half1,
+		},
+	}
+
+	type visit struct {
+		uid  keybase1.UID
+		key  kbfscrypto.CryptPublicKey
+		half kbfscrypto.TLFCryptKeyServerHalf
+	}
+	var visits []visit
+	serverHalves.ForEachSorted(func(uid keybase1.UID,
+		key kbfscrypto.CryptPublicKey,
+		half kbfscrypto.TLFCryptKeyServerHalf) {
+		visits = append(visits, visit{uid, key, half})
+	})
+	require.Equal(t, []visit{
+		{uid1, keys[0], half1},
+		{uid1, keys[1], half2},
+		{uid2, key1, half3},
+	}, visits)
+}
+
+func TestAssembleKeyInfos(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	perUser := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 1},
+		},
+		uid2: {
+			key2: TLFCryptKeyInfo{EPubKeyIndex: 2},
+		},
+	}
+
+	assembled, err := AssembleKeyInfos(perUser)
+	require.NoError(t, err)
+	require.Equal(t, perUser, assembled)
+
+	assembled[uid1][key2] = TLFCryptKeyInfo{}
+	require.Len(t, perUser[uid1], 1)
+
+	perUser[uid2] = nil
+	_, err = AssembleKeyInfos(perUser)
+	require.Error(t, err)
+	require.Equal(t, fmt.Sprintf("nil key infos for user %s", uid2),
+		err.Error())
+}
+
+func TestPartitionByReaderRekey(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	infos := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 0},
+			key2: TLFCryptKeyInfo{EPubKeyIndex: -1},
+		},
+		uid2: {
+			key3: TLFCryptKeyInfo{EPubKeyIndex: 2},
+		},
+	}
+
+	writers, readers := PartitionByReaderRekey(infos)
+	require.Equal(t,
+		map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+			uid1: {
+				key1: TLFCryptKeyInfo{EPubKeyIndex: 0},
+			},
+			uid2: {
+				key3: TLFCryptKeyInfo{EPubKeyIndex: 2},
+			},
+		}, writers)
+	require.Equal(t,
+		map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+			uid1: {
+				key2: TLFCryptKeyInfo{EPubKeyIndex: -1},
+			},
+		}, readers)
+}
+
+func TestServerHalfRemovalInfoAllDevicesIn(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+
+	info := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {makeTestServerHalfID(t, uid1, key1, 0x1)},
+				key2: {makeTestServerHalfID(t, uid1, key2, 0x2)},
+			},
+		},
+	}
+
+	roster := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true},
+	}
+	allIn, unknown := info.AllDevicesIn(roster)
+	require.False(t, allIn)
+	require.Equal(t, UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key2: true},
+	}, unknown)
+
+	roster[uid1][key2] = true
+	allIn, unknown = info.AllDevicesIn(roster)
+	require.True(t, allIn)
+	require.Nil(t, unknown)
+}
+
+func TestResplitWithNewEphemeral(t *testing.T) {
+	privKey1 := kbfscrypto.MakeFakeCryptPrivateKeyOrBust("key1")
+	privKey2 := kbfscrypto.MakeFakeCryptPrivateKeyOrBust("key2")
+	key1 := privKey1.GetPublicKey()
+	key2 := privKey2.GetPublicKey()
+	privKeys := map[kbfscrypto.CryptPublicKey]kbfscrypto.CryptPrivateKey{
+		key1: privKey1,
+		key2: privKey2,
+	}
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	tlfCryptKey := kbfscrypto.MakeFakeTLFCryptKeyOrBust("tlf key")
+	existing := UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{
+			key1: kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x1}),
+			key2: kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x2}),
+		},
+		uid2: DeviceKeyServerHalves{
+			key1: kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x3}),
+		},
+	}
+	pubKeys := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true},
+		uid2: DevicePublicKeys{key1: true},
+	}
+
+	ePubKey, ePrivKey, err := kbfscrypto.MakeRandomTLFEphemeralKeys()
+	require.NoError(t, err)
+
+	infos, err := ResplitWithNewEphemeral(
+		existing, tlfCryptKey, ePrivKey, 3, pubKeys)
+	require.NoError(t, err)
+	require.True(t, pubKeys.Equals(keyInfosToPublicKeys(infos)))
+
+	for uid, deviceInfos := range infos {
+		for key, info := range deviceInfos {
+			require.Equal(t, 3, info.EPubKeyIndex)
+
+			serverHalf := existing[uid][key]
+			expectedID, err := kbfscrypto.MakeTLFCryptKeyServerHalfID(
+				uid, key, serverHalf)
+			require.NoError(t, err)
+			require.Equal(t, expectedID, info.ServerHalfID)
+
+			clientHalf, err := kbfscrypto.DecryptTLFCryptKeyClientHalf(
+				privKeys[key], ePubKey, info.ClientHalf)
+			require.NoError(t, err)
+			require.Equal(t, tlfCryptKey,
+				kbfscrypto.UnmaskTLFCryptKey(serverHalf, clientHalf))
+		}
+	}
+
+	delete(existing[uid2], key1)
+	_, err = ResplitWithNewEphemeral(
+		existing, tlfCryptKey, ePrivKey, 3, pubKeys)
+	require.Error(t, err)
+	require.Equal(t, fmt.Sprintf(
+		"no existing server half for user %s and device %s", uid2, key1),
+		err.Error())
+}
+
+func TestRekeyOutputUsers(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+	uid3 := keybase1.MakeTestUID(0x3)
+
+	infos := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid3: {
+			key1: TLFCryptKeyInfo{},
+		},
+		uid2: {},
+		uid1: {
+			key1: TLFCryptKeyInfo{},
+		},
+	}
+
+	require.Equal(t, []keybase1.UID{uid1, uid3}, RekeyOutputUsers(infos))
+}
+
+func TestServerHalfRemovalInfoAssertUniformGenerations(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	info := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {
+					makeTestServerHalfID(t, uid1, key1, 0x1),
+					makeTestServerHalfID(t, uid1, key1, 0x2),
+				},
+				key2: {
+					makeTestServerHalfID(t, uid1, key2, 0x3),
+					makeTestServerHalfID(t, uid1, key2, 0x4),
+				},
+			},
+		},
+		uid2: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {
+					makeTestServerHalfID(t, uid2, key1, 0x5),
+					makeTestServerHalfID(t, uid2, key1, 0x6),
+				},
+			},
+		},
+	}
+	require.NoError(t, info.AssertUniformGenerations())
+
+	info[uid2].DeviceServerHalfIDs[key1] =
+		info[uid2].DeviceServerHalfIDs[key1][:1]
+	err := info.AssertUniformGenerations()
+	require.Error(t, err)
+	require.Equal(t, fmt.Sprintf(
+		"expected 2 keys, got 1 for user %s and device %s", uid2, key1),
+		err.Error())
+}
+
+func TestNewUsersInRekey(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	prior := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{},
+		},
+	}
+	current := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{},
+			key2: TLFCryptKeyInfo{},
+		},
+		uid2: {
+			key1: TLFCryptKeyInfo{},
+		},
+	}
+
+	require.Equal(t, []keybase1.UID{uid2}, NewUsersInRekey(current, prior))
+	require.Nil(t, NewUsersInRekey(prior, current))
+}
+
+func TestClientHalfFromServerHalf(t *testing.T) {
+	tlfCryptKey := kbfscrypto.MakeFakeTLFCryptKeyOrBust("tlf key")
+	serverHalf := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x1, 0x2})
+
+	clientHalf := ClientHalfFromServerHalf(serverHalf, tlfCryptKey)
+	require.NotEqual(t, tlfCryptKey.Data(), clientHalf.Data())
+	require.Equal(t, tlfCryptKey,
+		kbfscrypto.UnmaskTLFCryptKey(serverHalf, clientHalf))
+}
+
+func TestValidateAddRemoveDisjoint(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	added := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true},
+		uid2: DevicePublicKeys{key1: true},
+	}
+	removed := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key2: true},
+	}
+	require.NoError(t, ValidateAddRemoveDisjoint(added, removed))
+
+	removed[uid2] = DevicePublicKeys{key1: true}
+	err := ValidateAddRemoveDisjoint(added, removed)
+	require.Error(t, err)
+	require.Equal(t, fmt.Sprintf(
+		"device %s for user %s is both added and removed", key1, uid2),
+		err.Error())
+}
+
+func TestServerHalfRemovalInfoSignatureInput(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+	uid3 := keybase1.MakeTestUID(0x3)
+
+	id1a := makeTestServerHalfID(t, uid1, key1, 0x1)
+	id1b := makeTestServerHalfID(t, uid1, key1, 0x2)
+	id2a := makeTestServerHalfID(t, uid1, key2, 0x3)
+	id3a := makeTestServerHalfID(t, uid2, key3, 0x4)
+	id4a := makeTestServerHalfID(t, uid3, key1, 0x5)
+
+	codec := kbfscodec.NewMsgpack()
+
+	// Build the same plan in two different insertion orders.
+	info1 := make(ServerHalfRemovalInfo)
+	info1[uid1] = UserServerHalfRemovalInfo{
+		UserRemoved:         true,
+		DeviceServerHalfIDs: make(DeviceServerHalfRemovalInfo),
+	}
+	info1[uid1].DeviceServerHalfIDs[key1] =
+		[]kbfscrypto.TLFCryptKeyServerHalfID{id1a, id1b}
+	info1[uid1].DeviceServerHalfIDs[key2] =
+		[]kbfscrypto.TLFCryptKeyServerHalfID{id2a}
+	info1[uid2] = UserServerHalfRemovalInfo{
+		DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+			key3: {id3a},
+		},
+	}
+	info1[uid3] = UserServerHalfRemovalInfo{
+		DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+			key1: {id4a},
+		},
+	}
+
+	info2 := make(ServerHalfRemovalInfo)
+	info2[uid3] = UserServerHalfRemovalInfo{
+		DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+			key1: {id4a},
+			key2: {},
+		},
+	}
+	info2[uid2] = UserServerHalfRemovalInfo{
+		DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+			key3: {id3a},
+		},
+	}
+	info2[uid1] = UserServerHalfRemovalInfo{
+		UserRemoved:         true,
+		DeviceServerHalfIDs: make(DeviceServerHalfRemovalInfo),
+	}
+	info2[uid1].DeviceServerHalfIDs[key2] =
+		[]kbfscrypto.TLFCryptKeyServerHalfID{id2a}
+	info2[uid1].DeviceServerHalfIDs[key1] =
+		[]kbfscrypto.TLFCryptKeyServerHalfID{id1a, id1b}
+
+	buf1, err := info1.SignatureInput(codec)
+	require.NoError(t, err)
+	buf2, err := info2.SignatureInput(codec)
+	require.NoError(t, err)
+	require.Equal(t, buf1, buf2)
+
+	// Changing a flag or the ID order changes the input.
+	info2[uid2] = UserServerHalfRemovalInfo{
+		UserRemoved:         true,
+		DeviceServerHalfIDs: info2[uid2].DeviceServerHalfIDs,
+	}
+	buf2, err = info2.SignatureInput(codec)
+	require.NoError(t, err)
+	require.NotEqual(t, buf1, buf2)
+
+	info1[uid1].DeviceServerHalfIDs[key1] =
+		[]kbfscrypto.TLFCryptKeyServerHalfID{id1b, id1a}
+	buf3, err := info1.SignatureInput(codec)
+	require.NoError(t, err)
+	require.NotEqual(t, buf1, buf3)
+
+	// Evicting a removed user with no devices isn't a no-op.
+	uid4 := keybase1.MakeTestUID(0x4)
+	info1[uid4] = UserServerHalfRemovalInfo{
+		UserRemoved:         true,
+		DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{},
+	}
+	buf4, err := info1.SignatureInput(codec)
+	require.NoError(t, err)
+	require.NotEqual(t, buf3, buf4)
+}
+
+func TestServerHalfRemovalInfoDeviceCountsBySplit(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+	uid3 := keybase1.MakeTestUID(0x3)
+
+	info := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {makeTestServerHalfID(t, uid1, key1, 0x1)},
+				key2: {makeTestServerHalfID(t, uid1, key2, 0x2)},
+			},
+		},
+		uid2: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key3: {makeTestServerHalfID(t, uid2, key3, 0x3)},
+			},
+		},
+		uid3: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {makeTestServerHalfID(t, uid3, key1, 0x4)},
+			},
+		},
+	}
+
+	fullyRemovedDevices, partiallyRemovedDevices :=
+		info.DeviceCountsBySplit()
+	require.Equal(t, 3, fullyRemovedDevices)
+	require.Equal(t, 1, partiallyRemovedDevices)
+}
+
+func TestServerHalfRemovalInfoForUser(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	id1a := makeTestServerHalfID(t, uid1, key1, 0x1)
+	id1b := makeTestServerHalfID(t, uid1, key1, 0x2)
+
+	info := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {id1a},
+			},
+		},
+	}
+
+	userRemovalInfo, ok := info.ForUser(uid1)
+	require.True(t, ok)
+	require.Equal(t, info[uid1], userRemovalInfo)
+
+	userRemovalInfo.DeviceServerHalfIDs[key1][0] = id1b
+	userRemovalInfo.DeviceServerHalfIDs[key1] = append(
+		userRemovalInfo.DeviceServerHalfIDs[key1], id1a)
+	require.Equal(t, []kbfscrypto.TLFCryptKeyServerHalfID{id1a},
+		info[uid1].DeviceServerHalfIDs[key1])
+
+	_, ok = info.ForUser(uid2)
+	require.False(t, ok)
+}
+
+func TestServerHalfRemovalInfoSetUser(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+
+	userRemovalInfo := UserServerHalfRemovalInfo{
+		UserRemoved: true,
+		DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+			key1: {makeTestServerHalfID(t, uid1, key1, 0x1)},
+		},
+	}
+
+	info := make(ServerHalfRemovalInfo)
+	err := info.SetUser(uid1, userRemovalInfo)
+	require.NoError(t, err)
+	require.Equal(t, ServerHalfRemovalInfo{
+		uid1: userRemovalInfo,
+	}, info)
+
+	err = info.SetUser(uid1, UserServerHalfRemovalInfo{})
+	require.Error(t, err)
+	require.True(t, strings.HasPrefix(err.Error(),
+		fmt.Sprintf("user %s is already in", uid1)), "err=%v", err)
+	require.Equal(t, userRemovalInfo, info[uid1])
+
+	// A nil info is allocated, as for a zero-valued var.
+	var nilInfo ServerHalfRemovalInfo
+	err = nilInfo.SetUser(uid1, userRemovalInfo)
+	require.NoError(t, err)
+	require.Equal(t, ServerHalfRemovalInfo{
+		uid1: userRemovalInfo,
+	}, nilInfo)
+}
+
+func TestRekeyOutputsSameRoster(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+
+	makeInfo := func(data string) TLFCryptKeyInfo {
+		return TLFCryptKeyInfo{
+			ClientHalf: kbfscrypto.MakeEncryptedTLFCryptKeyClientHalfForTest(
+				kbfscrypto.EncryptionSecretbox,
+				[]byte(data), []byte("fake nonce")),
+		}
+	}
+
+	a := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: makeInfo("data 1"),
+			key2: makeInfo("data 2"),
+		},
+	}
+	b := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: makeInfo("data 3"),
+			key2: makeInfo("data 4"),
+		},
+	}
+	require.True(t, RekeyOutputsSameRoster(a, b))
+
+	delete(b[uid1], key2)
+	require.False(t, RekeyOutputsSameRoster(a, b))
+}
+
+func TestUserDevicePublicKeysComplement(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	roster := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true},
+		uid2: DevicePublicKeys{key1: true},
+	}
+	subset := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true},
+		uid2: DevicePublicKeys{key1: true},
+	}
+
+	require.Equal(t, UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key2: true},
+	}, roster.Complement(subset))
+}
+
+func TestDevicesUsingEPubKeyIndex(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	infos := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 1},
+			key2: TLFCryptKeyInfo{EPubKeyIndex: 0},
+		},
+		uid2: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 0},
+		},
+	}
+
+	require.Equal(t, UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key2: true},
+		uid2: DevicePublicKeys{key1: true},
+	}, DevicesUsingEPubKeyIndex(infos, 0))
+	require.Equal(t, UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true},
+	}, DevicesUsingEPubKeyIndex(infos, 1))
+	require.Empty(t, DevicesUsingEPubKeyIndex(infos, 2))
+}
+
+func TestValidateRekeyOutputSize(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	infos := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{},
+			key2: TLFCryptKeyInfo{},
+		},
+		uid2: {
+			key1: TLFCryptKeyInfo{},
+		},
+	}
+
+	require.NoError(t, ValidateRekeyOutputSize(infos, 4))
+	require.NoError(t, ValidateRekeyOutputSize(infos, 3))
+	err := ValidateRekeyOutputSize(infos, 2)
+	require.Error(t, err)
+	require.Equal(t, "device count=3 > max device count=2", err.Error())
+}
+
+func TestMergeKeyInfos(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	base := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 0},
+			key2: TLFCryptKeyInfo{EPubKeyIndex: 0},
+		},
+	}
+	updates := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key2: TLFCryptKeyInfo{EPubKeyIndex: 1},
+		},
+		uid2: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 1},
+		},
+	}
+
+	merged := MergeKeyInfos(base, updates)
+	require.Equal(t,
+		map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+			uid1: {
+				key1: TLFCryptKeyInfo{EPubKeyIndex: 0},
+				key2: TLFCryptKeyInfo{EPubKeyIndex: 1},
+			},
+			uid2: {
+				key1: TLFCryptKeyInfo{EPubKeyIndex: 1},
+			},
+		}, merged)
+	require.Equal(t, 0, base[uid1][key2].EPubKeyIndex)
+	require.NotContains(t, base, uid2)
+}
+
+func TestFindOrphanedServerHalves(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+
+	half1 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x1})
+	half2 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x2})
+
+	infos := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{},
+		},
+	}
+	halves := UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{
+			key1: half1,
+			key2: half2,
+		},
+	}
+
+	require.Equal(t, UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{
+			key2: half2,
+		},
+	}, FindOrphanedServerHalves(infos, halves))
+
+	infos[uid1][key2] = TLFCryptKeyInfo{}
+	require.Empty(t, FindOrphanedServerHalves(infos, halves))
+}
+
+func TestRekeyCoverage(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	half := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x1})
+
+	target := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true},
+		uid2: DevicePublicKeys{key1: true, key2: true},
+	}
+
+	done := UserDeviceKeyServerHalves{}
+	require.Equal(t, 0.0, RekeyCoverage(done, target))
+
+	done[uid1] = DeviceKeyServerHalves{
+		key1: half,
+		key2: half,
+	}
+	require.Equal(t, 0.5, RekeyCoverage(done, target))
+
+	done[uid2] = DeviceKeyServerHalves{
+		key1: half,
+		key2: half,
+	}
+	require.Equal(t, 1.0, RekeyCoverage(done, target))
+}
+
+func TestServerHalfRemovalInfoFromIDs(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	ids := map[keybase1.UID]map[kbfscrypto.CryptPublicKey][]kbfscrypto.TLFCryptKeyServerHalfID{
+		uid1: {
+			key1: {makeTestServerHalfID(t, uid1, key1, 0x1)},
+			key2: {makeTestServerHalfID(t, uid1, key2, 0x2)},
+		},
+		uid2: {
+			key1: {makeTestServerHalfID(t, uid2, key1, 0x3)},
+		},
+	}
+
+	info, err := ServerHalfRemovalInfoFromIDs(
+		ids, map[keybase1.UID]bool{uid2: true})
+	require.NoError(t, err)
+	require.Equal(t, ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			UserRemoved: false,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: ids[uid1][key1],
+				key2: ids[uid1][key2],
+			},
+		},
+		uid2: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: ids[uid2][key1],
+			},
+		},
+	}, info)
+
+	ids[uid2][key2] = nil
+	_, err = ServerHalfRemovalInfoFromIDs(ids, nil)
+	require.Error(t, err)
+	require.Equal(t, fmt.Sprintf(
+		"no server half IDs for user %s and device %s", uid2, key2),
+		err.Error())
+}
+
+func TestFindDuplicateServerHalfIDs(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	id1 := makeTestServerHalfID(t, uid1, key1, 0x1)
+	id2 := makeTestServerHalfID(t, uid1, key2, 0x2)
+	id3 := makeTestServerHalfID(t, uid2, key3, 0x3)
+
+	infos := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{ServerHalfID: id1},
+			key2: TLFCryptKeyInfo{ServerHalfID: id2},
+		},
+		uid2: {
+			key3: TLFCryptKeyInfo{ServerHalfID: id3},
+		},
+	}
+	require.Empty(t, FindDuplicateServerHalfIDs(infos))
+
+	infos[uid2][key3] = TLFCryptKeyInfo{ServerHalfID: id1}
+	require.Equal(t,
+		map[kbfscrypto.TLFCryptKeyServerHalfID][]kbfscrypto.CryptPublicKey{
+			id1: sortCryptPublicKeys(
+				[]kbfscrypto.CryptPublicKey{key1, key3}),
+		}, FindDuplicateServerHalfIDs(infos))
+}
+
+func TestServerHalvesDelta(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	half1 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x1})
+	half2 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x2})
+
+	prior := UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{
+			key1: half1,
+			key2: half1,
+			key3: half1,
+		},
+	}
+	current := UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{
+			// key1 is unchanged, key2 is changed, and key3
+			// is removed.
+			key1: half1,
+			key2: half2,
+		},
+		uid2: DeviceKeyServerHalves{
+			key1: half1,
+			key2: half2,
+		},
+	}
+
+	added, removed, changed := ServerHalvesDelta(prior, current)
+	require.Equal(t, 2, added)
+	require.Equal(t, 1, removed)
+	require.Equal(t, 1, changed)
+}
+
+func TestUserDeviceKeyServerHalvesFromEntries(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	half1 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x1})
+	half2 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x2})
+	half3 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x3})
+
+	entries := []UserDeviceKeyServerHalfEntry{
+		{uid1, key1, half1},
+		{uid1, key2, half2},
+		{uid2, key1, half3},
+	}
+	serverHalves, err := UserDeviceKeyServerHalvesFromEntries(entries)
+	require.NoError(t, err)
+	require.Equal(t, UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{
+			key1: half1,
+			key2: half2,
+		},
+		uid2: DeviceKeyServerHalves{
+			key1: half3,
+		},
+	}, serverHalves)
+
+	entries = append(entries, UserDeviceKeyServerHalfEntry{
+		uid1, key2, half3})
+	_, err = UserDeviceKeyServerHalvesFromEntries(entries)
+	require.Error(t, err)
+	require.Equal(t, fmt.Sprintf(
+		"duplicate entry for user %s and device %s", uid1, key2),
+		err.Error())
+}
+
+func TestUserDeviceKeyServerHalvesEntries(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	serverHalves := UserDeviceKeyServerHalves{
+		uid2: DeviceKeyServerHalves{
+			key1: kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x3}),
+		},
+		uid1: DeviceKeyServerHalves{
+			key1: kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x1}),
+			key2: kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x2}),
+		},
+	}
+
+	entries := serverHalves.Entries()
+	require.Len(t, entries, 3)
+	require.Equal(t, uid1, entries[0].UID)
+	require.Equal(t, uid1, entries[1].UID)
+	require.Equal(t, uid2, entries[2].UID)
+	require.Equal(t, entries, serverHalves.Entries())
+
+	roundTripped, err := UserDeviceKeyServerHalvesFromEntries(entries)
+	require.NoError(t, err)
+	require.Equal(t, serverHalves, roundTripped)
+}
+
+func TestRekeyOutputHasDevice(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	infos := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{},
+		},
+	}
+
+	require.True(t, RekeyOutputHasDevice(infos, uid1, key1))
+	require.False(t, RekeyOutputHasDevice(infos, uid1, key2))
+	require.False(t, RekeyOutputHasDevice(infos, uid2, key1))
+	require.False(t, RekeyOutputHasDevice(nil, uid1, key1))
+}
+
+func TestUserDevicePublicKeysMergeWith(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+	uid3 := keybase1.MakeTestUID(0x3)
+
+	udpk := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true},
+		uid2: DevicePublicKeys{key1: true},
+	}
+	other := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key3: true},
+		uid3: DevicePublicKeys{key2: true},
+	}
+
+	var conflicts []keybase1.UID
+	union := udpk.MergeWith(other, func(uid keybase1.UID,
+		existing, incoming DevicePublicKeys) DevicePublicKeys {
+		conflicts = append(conflicts, uid)
+		return existing.union(incoming)
+	})
+	require.Equal(t, []keybase1.UID{uid1}, conflicts)
+	require.Equal(t, UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true, key3: true},
+		uid2: DevicePublicKeys{key1: true},
+		uid3: DevicePublicKeys{key2: true},
+	}, union)
+	require.Equal(t, union, udpk.MergeWith(other, nil))
+
+	preferIncoming := udpk.MergeWith(other, func(_ keybase1.UID,
+		_, incoming DevicePublicKeys) DevicePublicKeys {
+		return incoming
+	})
+	require.Equal(t, UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key3: true},
+		uid2: DevicePublicKeys{key1: true},
+		uid3: DevicePublicKeys{key2: true},
+	}, preferIncoming)
+
+	// Neither input should be modified.
+	require.Len(t, udpk[uid1], 2)
+	require.Len(t, other[uid1], 1)
+}
+
+func TestServerHalfRemovalInfoFindZeroIDs(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	id1 := makeTestServerHalfID(t, uid1, key1, 0x1)
+	id2 := makeTestServerHalfID(t, uid2, key2, 0x2)
+
+	info := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {id1},
+			},
+		},
+		uid2: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key2: {id2},
+			},
+		},
+	}
+	require.Nil(t, info.FindZeroIDs())
+
+	info[uid2].DeviceServerHalfIDs[key2] = append(
+		info[uid2].DeviceServerHalfIDs[key2],
+		kbfscrypto.TLFCryptKeyServerHalfID{})
+	require.Equal(t, []ServerHalfRemovalInfoLocation{
+		{UID: uid2, Key: key2, Index: 1},
+	}, info.FindZeroIDs())
+}
+
+func TestUserDevicePublicKeysIntersection(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+	uid3 := keybase1.MakeTestUID(0x3)
+
+	writers := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true},
+		uid2: DevicePublicKeys{key1: true},
+	}
+	readers := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key2: true, key3: true},
+		uid2: DevicePublicKeys{key2: true},
+		uid3: DevicePublicKeys{key1: true},
+	}
+
+	expected := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key2: true},
+	}
+	require.Equal(t, expected, writers.Intersection(readers))
+	require.Equal(t, expected, readers.Intersection(writers))
+
+	disjoint := UserDevicePublicKeys{
+		uid3: DevicePublicKeys{key3: true},
+	}
+	require.Equal(t, UserDevicePublicKeys{}, writers.Intersection(disjoint))
+}
+
+func TestAssertRekeyOutputRoster(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	infos := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{},
+			key2: TLFCryptKeyInfo{},
+		},
+		uid2: {
+			key3: TLFCryptKeyInfo{},
+		},
+	}
+
+	require.NoError(t, AssertRekeyOutputRoster(infos, UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true},
+		uid2: DevicePublicKeys{key3: true},
+	}))
+
+	err := AssertRekeyOutputRoster(infos, UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true, key3: true},
+		uid2: DevicePublicKeys{key3: true},
+	})
+	require.Equal(t, fmt.Sprintf(
+		"rekey output roster mismatch: missing=[user %s, device %s], "+
+			"extra=[]", uid1, key3), err.Error())
+
+	err = AssertRekeyOutputRoster(infos, UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true},
+	})
+	require.Equal(t, fmt.Sprintf(
+		"rekey output roster mismatch: missing=[], "+
+			"extra=[user %s, device %s]", uid2, key3), err.Error())
+}
+
+func TestServerHalfRemovalInfoEstimatedByteSize(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+
+	info := ServerHalfRemovalInfo{}
+	require.Equal(t, 0, info.EstimatedByteSize())
+
+	info[uid1] = UserServerHalfRemovalInfo{
+		DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+			key1: {makeTestServerHalfID(t, uid1, key1, 0x1)},
+		},
+	}
+	size1 := info.EstimatedByteSize()
+	require.True(t, size1 > 0)
+
+	info[uid1].DeviceServerHalfIDs[key1] = append(
+		info[uid1].DeviceServerHalfIDs[key1],
+		makeTestServerHalfID(t, uid1, key1, 0x2))
+	size2 := info.EstimatedByteSize()
+	require.True(t, size2 > size1)
+
+	info[uid1].DeviceServerHalfIDs[key2] = []kbfscrypto.TLFCryptKeyServerHalfID{
+		makeTestServerHalfID(t, uid1, key2, 0x3),
+	}
+	require.True(t, info.EstimatedByteSize() > size2)
+}
+
+func TestDevicePublicKeysIsStrictSubsetOf(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	dpk := DevicePublicKeys{key1: true, key2: true}
+
+	require.False(t, dpk.IsStrictSubsetOf(
+		DevicePublicKeys{key1: true, key2: true}))
+	require.True(t, dpk.IsStrictSubsetOf(
+		DevicePublicKeys{key1: true, key2: true, key3: true}))
+	require.False(t, dpk.IsStrictSubsetOf(
+		DevicePublicKeys{key1: true, key3: true}))
+	require.True(t, DevicePublicKeys{}.IsStrictSubsetOf(dpk))
+	require.False(t, DevicePublicKeys{}.IsStrictSubsetOf(DevicePublicKeys{}))
+}
+
+func TestMakeUserFullRemovalInfo(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+
+	id1a := makeTestServerHalfID(t, uid1, key1, 0x1)
+	id1b := makeTestServerHalfID(t, uid1, key1, 0x2)
+	id2 := makeTestServerHalfID(t, uid1, key2, 0x3)
+
+	devices := DevicePublicKeys{key1: true, key2: true}
+	idsByDevice := map[kbfscrypto.CryptPublicKey][]kbfscrypto.TLFCryptKeyServerHalfID{
+		key1: {id1a, id1b},
+		key2: {id2},
+	}
+
+	ri, err := MakeUserFullRemovalInfo(devices, idsByDevice)
+	require.NoError(t, err)
+	require.Equal(t, UserServerHalfRemovalInfo{
+		UserRemoved: true,
+		DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+			key1: {id1a, id1b},
+			key2: {id2},
+		},
+	}, ri)
+
+	delete(idsByDevice, key2)
+	_, err = MakeUserFullRemovalInfo(devices, idsByDevice)
+	require.Equal(t, fmt.Sprintf(
+		"no server half IDs for device %s", key2), err.Error())
+}
+
+func TestHasReaderRekeyEntries(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	infos := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 0},
+			key2: TLFCryptKeyInfo{EPubKeyIndex: 1},
+		},
+	}
+	require.False(t, HasReaderRekeyEntries(infos))
+	require.False(t, HasReaderRekeyEntries(nil))
+
+	infos[uid2] = map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		key1: TLFCryptKeyInfo{EPubKeyIndex: -1},
+	}
+	require.True(t, HasReaderRekeyEntries(infos))
+}
+
+func TestDeviceGenerationSpans(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+
+	half1 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x1})
+	half2 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x2})
+	half3 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x3})
+	half4 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x4})
+
+	perGen := []UserDeviceKeyServerHalves{
+		{uid1: DeviceKeyServerHalves{key1: half1, key2: half2}},
+		{uid1: DeviceKeyServerHalves{key2: half3}},
+		{uid1: DeviceKeyServerHalves{key1: half4}},
+	}
+
+	require.Equal(t, map[keybase1.UID]map[kbfscrypto.CryptPublicKey][]int{
+		uid1: {
+			key1: {0, 2},
+			key2: {0, 1},
+		},
+	}, DeviceGenerationSpans(perGen))
+}
+
+func TestUnionServerHalfRemovalInfos(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	id1a := makeTestServerHalfID(t, uid1, key1, 0x1)
+	id1b := makeTestServerHalfID(t, uid1, key1, 0x2)
+	id2a := makeTestServerHalfID(t, uid2, key2, 0x3)
+	id2b := makeTestServerHalfID(t, uid2, key2, 0x4)
+
+	gen1 := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {id1a},
+			},
+		},
+		uid2: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key2: {id2a},
+			},
+		},
+	}
+	gen2 := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {id1b},
+			},
+		},
+		uid2: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key2: {id2b},
+			},
+		},
+	}
+
+	union, err := UnionServerHalfRemovalInfos(
+		[]ServerHalfRemovalInfo{gen1, gen2})
+	require.NoError(t, err)
+	require.Equal(t, ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {id1a, id1b},
+			},
+		},
+		uid2: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key2: {id2a, id2b},
+			},
+		},
+	}, union)
+	// The inputs shouldn't be modified.
+	require.Equal(t, []kbfscrypto.TLFCryptKeyServerHalfID{id1a},
+		gen1[uid1].DeviceServerHalfIDs[key1])
+
+	delete(gen2, uid2)
+	_, err = UnionServerHalfRemovalInfos(
+		[]ServerHalfRemovalInfo{gen1, gen2})
+	require.Equal(t, "user count=2 != generation user count=1", err.Error())
+}
+
+func TestTLFCryptKeyInfoValidateClientHalf(t *testing.T) {
+	privKey := kbfscrypto.MakeFakeCryptPrivateKeyOrBust("key1")
+	_, ePrivKey, err := kbfscrypto.MakeRandomTLFEphemeralKeys()
+	require.NoError(t, err)
+
+	clientHalf := kbfscrypto.MakeTLFCryptKeyClientHalf([32]byte{0x1})
+	encryptedClientHalf, err := kbfscrypto.EncryptTLFCryptKeyClientHalf(
+		ePrivKey, privKey.GetPublicKey(), clientHalf)
+	require.NoError(t, err)
+
+	info := TLFCryptKeyInfo{ClientHalf: encryptedClientHalf}
+	require.NoError(t, info.ValidateClientHalf())
+
+	truncated := info
+	truncated.ClientHalf.EncryptedData =
+		info.ClientHalf.EncryptedData[:len(info.ClientHalf.EncryptedData)-1]
+	err = truncated.ValidateClientHalf()
+	require.Error(t, err)
+	require.True(t, strings.HasPrefix(err.Error(),
+		"Expected 48 bytes, got 47"))
+
+	badNonce := info
+	badNonce.ClientHalf.Nonce = info.ClientHalf.Nonce[:8]
+	err = badNonce.ValidateClientHalf()
+	require.IsType(t, kbfscrypto.InvalidNonceError{}, errors.Cause(err))
+
+	badVersion := info
+	badVersion.ClientHalf.Version = kbfscrypto.EncryptionSecretbox + 1
+	err = badVersion.ValidateClientHalf()
+	require.IsType(t, kbfscrypto.UnknownEncryptionVer{}, errors.Cause(err))
+}
+
+func TestUserDevicePublicKeysMergePreferringLargerPerUser(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+	uid3 := keybase1.MakeTestUID(0x3)
+	uid4 := keybase1.MakeTestUID(0x4)
+
+	udpk := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true},
+		uid2: DevicePublicKeys{key1: true},
+		uid3: DevicePublicKeys{key3: true},
+	}
+	other := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key2: true, key3: true},
+		uid2: DevicePublicKeys{key2: true},
+		uid4: DevicePublicKeys{key1: true},
+	}
+
+	require.Equal(t, UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key2: true, key3: true},
+		uid2: DevicePublicKeys{key1: true},
+		uid3: DevicePublicKeys{key3: true},
+		uid4: DevicePublicKeys{key1: true},
+	}, udpk.MergePreferringLargerPerUser(other))
+}
+
+func TestServerHalfRemovalInfoDeviceCountPerGeneration(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	info := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {
+					makeTestServerHalfID(t, uid1, key1, 0x1),
+					makeTestServerHalfID(t, uid1, key1, 0x2),
+				},
+				key2: {
+					makeTestServerHalfID(t, uid1, key2, 0x3),
+					makeTestServerHalfID(t, uid1, key2, 0x4),
+				},
+			},
+		},
+		uid2: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {
+					makeTestServerHalfID(t, uid2, key1, 0x5),
+				},
+			},
+		},
+	}
+	require.Equal(t, []int{3, 2}, info.DeviceCountPerGeneration())
+	require.Nil(t, ServerHalfRemovalInfo{}.DeviceCountPerGeneration())
+}
+
+func TestServerHalfRemovalInfoEncodeDecode(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	info := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {
+					makeTestServerHalfID(t, uid1, key1, 0x1),
+					makeTestServerHalfID(t, uid1, key1, 0x2),
+				},
+				key2: {
+					makeTestServerHalfID(t, uid1, key2, 0x3),
+					makeTestServerHalfID(t, uid1, key2, 0x4),
+				},
+			},
+		},
+		uid2: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key2: {
+					makeTestServerHalfID(t, uid2, key2, 0x5),
+				},
+			},
+		},
+	}
+
+	codec := kbfscodec.NewMsgpack()
+	data, err := info.Encode(codec)
+	require.NoError(t, err)
+
+	var decoded ServerHalfRemovalInfo
+	err = decoded.Decode(codec, data)
+	require.NoError(t, err)
+	require.Equal(t, info, decoded)
+
+	// Encoding should be deterministic even though map iteration
+	// order isn't.
+	for i := 0; i < 10; i++ {
+		data2, err := decoded.Encode(codec)
+		require.NoError(t, err)
+		require.Equal(t, data, data2)
+	}
+
+	// Removed users with no devices (as produced by
+	// RemoveDevicesNotIn), nil device maps, and devices with no
+	// server half IDs must all survive a round trip.
+	uid3 := keybase1.MakeTestUID(0x3)
+	uid4 := keybase1.MakeTestUID(0x4)
+	uid5 := keybase1.MakeTestUID(0x5)
+	info[uid3] = UserServerHalfRemovalInfo{
+		UserRemoved:         true,
+		DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{},
+	}
+	info[uid4] = UserServerHalfRemovalInfo{
+		UserRemoved: true,
+	}
+	info[uid5] = UserServerHalfRemovalInfo{
+		DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+			key1: nil,
+			key2: {},
+		},
+	}
+
+	data, err = info.Encode(codec)
+	require.NoError(t, err)
+
+	decoded = nil
+	err = decoded.Decode(codec, data)
+	require.NoError(t, err)
+	require.Equal(t, info, decoded)
+
+	// The default codec encoding is still a plain map, so values
+	// encoded that way, directly or embedded in another struct,
+	// still decode.
+	oldData, err := codec.Encode(
+		map[keybase1.UID]UserServerHalfRemovalInfo(info))
+	require.NoError(t, err)
+	data, err = codec.Encode(info)
+	require.NoError(t, err)
+	require.Equal(t, oldData, data)
+	decoded = nil
+	err = codec.Decode(data, &decoded)
+	require.NoError(t, err)
+	require.Equal(t, info, decoded)
+
+	type wrapper struct {
+		Info ServerHalfRemovalInfo
+	}
+	data, err = codec.Encode(wrapper{info})
+	require.NoError(t, err)
+	var decodedWrapper wrapper
+	err = codec.Decode(data, &decodedWrapper)
+	require.NoError(t, err)
+	require.Equal(t, wrapper{info}, decodedWrapper)
+
+	// And a plain map can't be mistaken for the Encode format.
+	data, err = codec.Encode(info)
+	require.NoError(t, err)
+	err = decoded.Decode(codec, data)
+	require.Error(t, err)
+}
+
+func TestRekeyOutputIsSuperset(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	prior := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{},
+		},
+	}
+
+	added := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 1},
+			key2: TLFCryptKeyInfo{},
+		},
+		uid2: {
+			key1: TLFCryptKeyInfo{},
+		},
+	}
+	require.True(t, RekeyOutputIsSuperset(added, prior))
+	require.True(t, RekeyOutputIsSuperset(prior, prior))
+
+	dropped := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key2: TLFCryptKeyInfo{},
+		},
+	}
+	require.False(t, RekeyOutputIsSuperset(dropped, prior))
+}
+
+func TestServerHalfRemovalInfoFirstGenerationForDevice(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	info := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {
+					{},
+					makeTestServerHalfID(t, uid1, key1, 0x1),
+				},
+				key2: {
+					{},
+				},
+			},
+		},
+	}
+
+	gen, ok := info.FirstGenerationForDevice(uid1, key1)
+	require.True(t, ok)
+	require.Equal(t, 1, gen)
+
+	gen, ok = info.FirstGenerationForDevice(uid1, key2)
+	require.True(t, ok)
+	require.Equal(t, -1, gen)
+
+	_, ok = info.FirstGenerationForDevice(uid1, key3)
+	require.False(t, ok)
+
+	_, ok = info.FirstGenerationForDevice(uid2, key1)
+	require.False(t, ok)
+}
+
+func TestUserDevicePublicKeysFlattenDevices(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+	uid3 := keybase1.MakeTestUID(0x3)
+
+	udpk := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true},
+		uid2: DevicePublicKeys{key2: true, key3: true},
+		uid3: DevicePublicKeys{},
+	}
+	require.Equal(t, DevicePublicKeys{
+		key1: true,
+		key2: true,
+		key3: true,
+	}, udpk.FlattenDevices())
+}
+
+func TestValidateRemovalAgainstRosters(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	before := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true},
+		uid2: DevicePublicKeys{key3: true},
+	}
+	after := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true},
+	}
+	info := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key2: {makeTestServerHalfID(t, uid1, key2, 0x1)},
+			},
+		},
+		uid2: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key3: {makeTestServerHalfID(t, uid2, key3, 0x2)},
+			},
+		},
+	}
+	require.NoError(t, ValidateRemovalAgainstRosters(before, after, info))
+
+	// The plan removes key1, but after still has it.
+	info[uid1].DeviceServerHalfIDs[key1] = []kbfscrypto.TLFCryptKeyServerHalfID{
+		makeTestServerHalfID(t, uid1, key1, 0x3),
+	}
+	err := ValidateRemovalAgainstRosters(before, after, info)
+	require.Equal(t, fmt.Sprintf(
+		"removal inconsistent with rosters: extra=[], "+
+			"missing=[user %s, device %s]", uid1, key1), err.Error())
+
+	// The plan doesn't remove key2, but after doesn't have it.
+	delete(info[uid1].DeviceServerHalfIDs, key1)
+	delete(info[uid1].DeviceServerHalfIDs, key2)
+	err = ValidateRemovalAgainstRosters(before, after, info)
+	require.Equal(t, fmt.Sprintf(
+		"removal inconsistent with rosters: "+
+			"extra=[user %s, device %s], missing=[]", uid1, key2),
+		err.Error())
+}
+
+func TestServerHalfRemovalInfoWithSortedIDs(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+
+	var ids []kbfscrypto.TLFCryptKeyServerHalfID
+	for i := byte(1); i <= 5; i++ {
+		ids = append(ids, makeTestServerHalfID(t, uid1, key1, i))
+	}
+	sortedIDs := append([]kbfscrypto.TLFCryptKeyServerHalfID(nil), ids...)
+	sortServerHalfIDs(sortedIDs)
+
+	reversed := make([]kbfscrypto.TLFCryptKeyServerHalfID, len(ids))
+	for i, id := range sortedIDs {
+		reversed[len(ids)-1-i] = id
+	}
+
+	info := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: reversed,
+			},
+		},
+	}
+
+	sorted := info.WithSortedIDs()
+	require.Equal(t, ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: sortedIDs,
+			},
+		},
+	}, sorted)
+	require.Equal(t, sorted, sorted.WithSortedIDs())
+
+	// The original order should be preserved.
+	require.Equal(t, sortedIDs[0], info[uid1].DeviceServerHalfIDs[key1][4])
+}
+
+func TestValidateEphemeralKeys(t *testing.T) {
+	err := validateEphemeralPrivateKey(kbfscrypto.TLFEphemeralPrivateKey{})
+	require.Equal(t, "zero ephemeral private key", err.Error())
+
+	ePubKey, ePrivKey, err := kbfscrypto.MakeRandomTLFEphemeralKeys()
+	require.NoError(t, err)
+	require.NoError(t, validateEphemeralPrivateKey(ePrivKey))
+	require.NoError(t, ValidateEphemeralKeyPair(ePrivKey, ePubKey))
+
+	err = ValidateEphemeralKeyPair(
+		kbfscrypto.TLFEphemeralPrivateKey{}, ePubKey)
+	require.Equal(t, "zero ephemeral private key", err.Error())
+
+	otherEPubKey, _, err := kbfscrypto.MakeRandomTLFEphemeralKeys()
+	require.NoError(t, err)
+	err = ValidateEphemeralKeyPair(ePrivKey, otherEPubKey)
+	require.Equal(t, fmt.Sprintf(
+		"ephemeral public key %s doesn't match private key",
+		otherEPubKey), err.Error())
+
+	// Splitting with a zero key should fail.
+	uid := keybase1.MakeTestUID(0x1)
+	key := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	_, _, err = splitTLFCryptKey(uid, kbfscrypto.MakeTLFCryptKey([32]byte{0x1}),
+		kbfscrypto.TLFEphemeralPrivateKey{}, 0, key)
+	require.Equal(t, "zero ephemeral private key", err.Error())
+
+	_, err = ResplitWithNewEphemeral(UserDeviceKeyServerHalves{
+		uid: DeviceKeyServerHalves{
+			key: kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x2}),
+		},
+	}, kbfscrypto.MakeTLFCryptKey([32]byte{0x1}),
+		kbfscrypto.TLFEphemeralPrivateKey{}, 1, UserDevicePublicKeys{
+			uid: DevicePublicKeys{key: true},
+		})
+	require.Equal(t, "zero ephemeral private key", err.Error())
+}
+
+func TestUserDevicePublicKeysSingleDeviceUsers(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+	uid3 := keybase1.MakeTestUID(0x3)
+	uid4 := keybase1.MakeTestUID(0x4)
+
+	udpk := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{},
+		uid2: DevicePublicKeys{key1: true},
+		uid3: DevicePublicKeys{key1: true, key2: true},
+		uid4: DevicePublicKeys{key2: true},
+	}
+	require.Equal(t, []keybase1.UID{uid2, uid4}, udpk.SingleDeviceUsers())
+	require.Nil(t, UserDevicePublicKeys{}.SingleDeviceUsers())
+}
+
+func TestUserDevicePublicKeysSymmetricDifference(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	a := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true},
+		uid2: DevicePublicKeys{key3: true},
+	}
+	b := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key2: true, key3: true},
+		uid2: DevicePublicKeys{key3: true},
+	}
+
+	expected := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key3: true},
+	}
+	require.Equal(t, expected, a.SymmetricDifference(b))
+	require.Equal(t, expected, b.SymmetricDifference(a))
+	require.Equal(t, UserDevicePublicKeys{}, a.SymmetricDifference(a))
+}
+
+func TestPlanEphemeralRotation(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	infos := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 0},
+			key2: TLFCryptKeyInfo{EPubKeyIndex: 1},
+		},
+		uid2: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 1},
+			// Uses the first reader ephemeral key.
+			key3: TLFCryptKeyInfo{EPubKeyIndex: -1},
+		},
+	}
+
+	require.Equal(t, UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key2: true},
+		uid2: DevicePublicKeys{key1: true},
+	}, PlanEphemeralRotation(infos, 1))
+	require.Equal(t, UserDevicePublicKeys{
+		uid2: DevicePublicKeys{key3: true},
+	}, PlanEphemeralRotation(infos, -1))
+	require.Equal(t, UserDevicePublicKeys{},
+		PlanEphemeralRotation(infos, 2))
+}
+
+func TestServerHalfRemovalInfoFindIntraDeviceDuplicateIDs(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+
+	id1 := makeTestServerHalfID(t, uid1, key1, 0x1)
+	id2 := makeTestServerHalfID(t, uid1, key1, 0x2)
+	id3 := makeTestServerHalfID(t, uid1, key2, 0x3)
+
+	info := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {id1, id2},
+				key2: {id3},
+			},
+		},
+	}
+	require.Nil(t, info.FindIntraDeviceDuplicateIDs())
+
+	info[uid1].DeviceServerHalfIDs[key1] = append(
+		info[uid1].DeviceServerHalfIDs[key1], id2, id2)
+	require.Equal(t, []UserDeviceServerHalfID{
+		{UID: uid1, Key: key1, ID: id2},
+	}, info.FindIntraDeviceDuplicateIDs())
+}
+
+func TestServerHalfRemovalInfoAllUsersSameGenerationCount(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	count, err := ServerHalfRemovalInfo{}.AllUsersSameGenerationCount()
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+
+	info := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {
+					makeTestServerHalfID(t, uid1, key1, 0x1),
+					makeTestServerHalfID(t, uid1, key1, 0x2),
+				},
+			},
+		},
+		uid2: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key2: {
+					makeTestServerHalfID(t, uid2, key2, 0x3),
+					makeTestServerHalfID(t, uid2, key2, 0x4),
+				},
+			},
+		},
+	}
+	count, err = info.AllUsersSameGenerationCount()
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	info[uid2].DeviceServerHalfIDs[key2] =
+		info[uid2].DeviceServerHalfIDs[key2][:1]
+	_, err = info.AllUsersSameGenerationCount()
+	require.Equal(t, fmt.Sprintf(
+		"expected 2 generations, got 1 for user %s", uid2), err.Error())
+}
+
+func TestDeviceKeyServerHalvesDeepCopy(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+
+	half1 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x1})
+	half2 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x2})
+
+	d := DeviceKeyServerHalves{key1: half1}
+	dCopy := d.DeepCopy()
+	require.Equal(t, d, dCopy)
+
+	dCopy[key1] = half2
+	dCopy[key2] = half2
+	require.Equal(t, DeviceKeyServerHalves{key1: half1}, d)
+
+	serverHalves := UserDeviceKeyServerHalves{uid1: d}
+	serverHalvesCopy := serverHalves.DeepCopy()
+	require.Equal(t, serverHalves, serverHalvesCopy)
+
+	serverHalvesCopy[uid1][key2] = half2
+	require.Equal(t, DeviceKeyServerHalves{key1: half1}, serverHalves[uid1])
+}
+
+func TestUserDeviceKeyServerHalvesHalfChanged(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+	key4 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key4")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+
+	half1 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x1})
+	half2 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x2})
+
+	a := UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{
+			key1: half1,
+			key2: half1,
+			key3: half1,
+		},
+	}
+	b := UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{
+			key1: half1,
+			key2: half2,
+		},
+	}
+
+	changed, presentInBoth := a.HalfChanged(b, uid1, key1)
+	require.False(t, changed)
+	require.True(t, presentInBoth)
+
+	changed, presentInBoth = a.HalfChanged(b, uid1, key2)
+	require.True(t, changed)
+	require.True(t, presentInBoth)
+
+	changed, presentInBoth = a.HalfChanged(b, uid1, key3)
+	require.True(t, changed)
+	require.False(t, presentInBoth)
+
+	changed, presentInBoth = b.HalfChanged(a, uid1, key3)
+	require.True(t, changed)
+	require.False(t, presentInBoth)
+
+	changed, presentInBoth = a.HalfChanged(b, uid1, key4)
+	require.False(t, changed)
+	require.False(t, presentInBoth)
+}
+
+func TestUserDevicePublicKeysSerializeCanonical(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	a := make(UserDevicePublicKeys)
+	a[uid1] = DevicePublicKeys{key1: true}
+	a[uid1][key2] = true
+	a[uid2] = DevicePublicKeys{key3: true}
+
+	b := make(UserDevicePublicKeys)
+	b[uid2] = DevicePublicKeys{key3: true}
+	b[uid1] = DevicePublicKeys{key2: true}
+	b[uid1][key1] = true
+
+	require.True(t, a.Equals(b))
+
+	codec := kbfscodec.NewMsgpack()
+	aData, err := a.SerializeCanonical(codec)
+	require.NoError(t, err)
+	bData, err := b.SerializeCanonical(codec)
+	require.NoError(t, err)
+	require.Equal(t, aData, bData)
+
+	delete(b[uid1], key1)
+	bData, err = b.SerializeCanonical(codec)
+	require.NoError(t, err)
+	require.NotEqual(t, aData, bData)
+}
+
+func TestServerHalfRemovalInfoGenerationsForDevice(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+
+	info := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {
+					makeTestServerHalfID(t, uid1, key1, 0x1),
+					{},
+					makeTestServerHalfID(t, uid1, key1, 0x2),
+				},
+			},
+		},
+	}
+
+	generations, ok := info.GenerationsForDevice(uid1, key1)
+	require.True(t, ok)
+	require.Equal(t, []int{0, 2}, generations)
+
+	_, ok = info.GenerationsForDevice(uid1, key2)
+	require.False(t, ok)
+}
+
+func TestMergeRekeyOutputsStrict(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+
+	half1 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x1})
+	half2 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x2})
+	half3 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x3})
+
+	info1 := TLFCryptKeyInfo{
+		ServerHalfID: makeTestServerHalfID(t, uid1, key1, 0x1),
+		EPubKeyIndex: 1,
+	}
+	info2 := TLFCryptKeyInfo{
+		ServerHalfID: makeTestServerHalfID(t, uid1, key2, 0x2),
+	}
+	info3 := TLFCryptKeyInfo{
+		ServerHalfID: makeTestServerHalfID(t, uid1, key3, 0x3),
+	}
+
+	infosA := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {key1: info1, key2: info2},
+	}
+	halvesA := UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{key1: half1, key2: half2},
+	}
+	infosB := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {key1: info1, key3: info3},
+	}
+	halvesB := UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{key1: half1, key3: half3},
+	}
+
+	infos, halves, err := MergeRekeyOutputsStrict(
+		infosA, infosB, halvesA, halvesB)
+	require.NoError(t, err)
+	require.Equal(t,
+		map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+			uid1: {key1: info1, key2: info2, key3: info3},
+		}, infos)
+	require.Equal(t, UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{
+			key1: half1,
+			key2: half2,
+			key3: half3,
+		},
+	}, halves)
+
+	// Conflicting key info.
+	infosB[uid1][key1] = TLFCryptKeyInfo{
+		ServerHalfID: info1.ServerHalfID,
+		EPubKeyIndex: 2,
+	}
+	_, _, err = MergeRekeyOutputsStrict(infosA, infosB, halvesA, halvesB)
+	require.Equal(t, fmt.Sprintf(
+		"conflicting key infos for user %s and device %s", uid1, key1),
+		err.Error())
+
+	// Conflicting server half.
+	infosB[uid1][key1] = info1
+	halvesB[uid1][key1] = half2
+	_, _, err = MergeRekeyOutputsStrict(infosA, infosB, halvesA, halvesB)
+	require.Equal(t, fmt.Sprintf(
+		"conflicting server halves for user %s and device %s", uid1, key1),
+		err.Error())
+}
+
+func TestDistinctEPubKeyIndicesAcross(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+
+	perGen := []map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		{
+			uid1: {
+				key1: TLFCryptKeyInfo{EPubKeyIndex: 0},
+				key2: TLFCryptKeyInfo{EPubKeyIndex: 1},
+			},
+		},
+		{
+			uid1: {
+				key1: TLFCryptKeyInfo{EPubKeyIndex: 1},
+				key2: TLFCryptKeyInfo{EPubKeyIndex: -1},
+			},
+		},
+	}
+	require.Equal(t, map[int]bool{-1: true, 0: true, 1: true},
+		DistinctEPubKeyIndicesAcross(perGen))
+	require.Equal(t, map[int]bool{}, DistinctEPubKeyIndicesAcross(nil))
+}
+
+func TestServerHalfRemovalInfoCoversDevices(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	info := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {makeTestServerHalfID(t, uid1, key1, 0x1)},
+			},
+		},
+	}
+
+	ok, uncovered := info.CoversDevices(UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true},
+	})
+	require.True(t, ok)
+	require.Nil(t, uncovered)
+
+	ok, uncovered = info.CoversDevices(UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true},
+		uid2: DevicePublicKeys{key1: true},
+	})
+	require.False(t, ok)
+	require.Equal(t, UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key2: true},
+		uid2: DevicePublicKeys{key1: true},
+	}, uncovered)
+}
+
+func TestChunkKeyInfos(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	infos := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 1},
+			key2: TLFCryptKeyInfo{EPubKeyIndex: 2},
+			key3: TLFCryptKeyInfo{EPubKeyIndex: 3},
+		},
+		uid2: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 4},
+			key2: TLFCryptKeyInfo{EPubKeyIndex: 5},
+		},
+	}
+
+	for maxDevices := 1; maxDevices <= 6; maxDevices++ {
+		chunks := ChunkKeyInfos(infos, maxDevices)
+		require.Len(t, chunks, (5+maxDevices-1)/maxDevices)
+		var union map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo
+		for _, chunk := range chunks {
+			deviceCount := 0
+			for _, deviceInfos := range chunk {
+				deviceCount += len(deviceInfos)
+			}
+			require.True(t, deviceCount <= maxDevices)
+			union = MergeKeyInfos(union, chunk)
+		}
+		require.Equal(t, infos, union)
+	}
+
+	require.Nil(t, ChunkKeyInfos(infos, 0))
+	require.Nil(t, ChunkKeyInfos(nil, 1))
+}
+
+func TestUserDevicePublicKeysUnchangedUsers(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+	uid3 := keybase1.MakeTestUID(0x3)
+
+	before := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true},
+		uid2: DevicePublicKeys{key1: true},
+		uid3: DevicePublicKeys{key2: true},
+	}
+	after := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true},
+		uid2: DevicePublicKeys{key2: true},
+	}
+	require.Equal(t, []keybase1.UID{uid1}, before.UnchangedUsers(after))
+	require.Equal(t, []keybase1.UID{uid1}, after.UnchangedUsers(before))
+}
+
+func TestServerHalfRemovalInfoReconcileWithDeleted(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	id1 := makeTestServerHalfID(t, uid1, key1, 0x1)
+	id2 := makeTestServerHalfID(t, uid1, key1, 0x2)
+	id3 := makeTestServerHalfID(t, uid2, key2, 0x3)
+	id4 := makeTestServerHalfID(t, uid2, key2, 0x4)
+
+	info := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {id1, id2},
+			},
+		},
+		uid2: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key2: {id3},
+			},
+		},
+	}
+
+	missing, extra := info.ReconcileWithDeleted(
+		map[kbfscrypto.TLFCryptKeyServerHalfID]bool{
+			id1: true,
+			id2: true,
+			id3: true,
+		})
+	require.Nil(t, missing)
+	require.Nil(t, extra)
+
+	missing, extra = info.ReconcileWithDeleted(
+		map[kbfscrypto.TLFCryptKeyServerHalfID]bool{
+			id1: true,
+			id4: true,
+		})
+	require.Equal(t, sortServerHalfIDs(
+		[]kbfscrypto.TLFCryptKeyServerHalfID{id2, id3}), missing)
+	require.Equal(t, []kbfscrypto.TLFCryptKeyServerHalfID{id4}, extra)
+}
+
+func TestServerHalfRemovalInfoIsEmpty(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+
+	require.True(t, ServerHalfRemovalInfo(nil).IsEmpty())
+
+	info := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: nil,
+			},
+		},
+	}
+	require.True(t, info.IsEmpty())
+
+	info[uid1].DeviceServerHalfIDs[key1] = []kbfscrypto.TLFCryptKeyServerHalfID{
+		makeTestServerHalfID(t, uid1, key1, 0x1),
+	}
+	require.False(t, info.IsEmpty())
+}
+
+func TestUserDevicePublicKeysValidateKeys(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	udpk := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true},
+		uid2: DevicePublicKeys{key1: true},
+	}
+	require.NoError(t, udpk.ValidateKeys())
+
+	// A signing key isn't a valid device crypt key.
+	verifyingKey := kbfscrypto.MakeFakeVerifyingKeyOrBust("key3")
+	badTypeKey := kbfscrypto.MakeCryptPublicKey(verifyingKey.KID())
+	udpk[uid2][badTypeKey] = true
+	err := udpk.ValidateKeys()
+	require.True(t, strings.HasPrefix(err.Error(), fmt.Sprintf(
+		"invalid device key %s for user %s", badTypeKey, uid2)))
+
+	delete(udpk[uid2], badTypeKey)
+	truncated := kbfscrypto.MakeCryptPublicKey(
+		key1.KID()[:len(key1.KID())-4])
+	udpk[uid1][truncated] = true
+	err = udpk.ValidateKeys()
+	require.True(t, strings.HasPrefix(err.Error(), fmt.Sprintf(
+		"invalid device key %s for user %s", truncated, uid1)))
+}
+
+func TestRekeyGap(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	half := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x1})
+
+	target := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true},
+		uid2: DevicePublicKeys{key1: true},
+	}
+	halves := UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{key1: half},
+		uid2: DeviceKeyServerHalves{key2: half},
+	}
+
+	covered, missing := RekeyGap(target, halves)
+	require.Equal(t, UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true},
+	}, covered)
+	require.Equal(t, UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key2: true},
+		uid2: DevicePublicKeys{key1: true},
+	}, missing)
+}
+
+func TestAssembleServerHalfRemovalInfo(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	id1 := makeTestServerHalfID(t, uid1, key1, 0x1)
+	id2 := makeTestServerHalfID(t, uid1, key2, 0x2)
+	id3 := makeTestServerHalfID(t, uid2, key1, 0x3)
+
+	perUser := map[keybase1.UID]UserServerHalfRemovalInfo{
+		uid1: {
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {id1},
+				key2: {id2},
+			},
+		},
+		uid2: {
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {id3},
+			},
+		},
+	}
+
+	info, err := AssembleServerHalfRemovalInfo(perUser)
+	require.NoError(t, err)
+	require.Equal(t, ServerHalfRemovalInfo(perUser), info)
+
+	// The result shouldn't share any maps with the input.
+	delete(info[uid1].DeviceServerHalfIDs, key2)
+	require.Len(t, perUser[uid1].DeviceServerHalfIDs, 2)
+
+	perUser[uid2] = UserServerHalfRemovalInfo{}
+	_, err = AssembleServerHalfRemovalInfo(perUser)
+	require.Equal(t, fmt.Sprintf(
+		"nil device server half IDs for user %s", uid2), err.Error())
+}
+
+func TestCommonEPubKeyIndices(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	a := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 0},
+			key2: TLFCryptKeyInfo{EPubKeyIndex: 1},
+		},
+		uid2: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: -1},
+		},
+	}
+	b := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 1},
+		},
+		uid2: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: -1},
+			key2: TLFCryptKeyInfo{EPubKeyIndex: 2},
+		},
+	}
+	require.Equal(t, map[int]bool{-1: true, 1: true},
+		CommonEPubKeyIndices(a, b))
+	require.Equal(t, map[int]bool{}, CommonEPubKeyIndices(a, nil))
+}
+
+func TestExtraDevicesInOutput(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	infos := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{},
+		},
+	}
+	intended := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true},
+	}
+	require.Equal(t, UserDevicePublicKeys{},
+		ExtraDevicesInOutput(infos, intended))
+
+	infos[uid1][key2] = TLFCryptKeyInfo{}
+	infos[uid2] = map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		key1: TLFCryptKeyInfo{},
+	}
+	require.Equal(t, UserDevicePublicKeys{
+		uid2: DevicePublicKeys{key1: true},
+	}, ExtraDevicesInOutput(infos, intended))
+}
+
+func TestUserDevicePublicKeysChangeSummary(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+	uid3 := keybase1.MakeTestUID(0x3)
+
+	prior := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true},
+		uid2: DevicePublicKeys{key1: true},
+		uid3: DevicePublicKeys{key1: true},
+	}
+	current := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key3: true},
+		uid2: DevicePublicKeys{key1: true},
+	}
+
+	require.Equal(t, map[keybase1.UID]DeviceChangeCounts{
+		uid1: {Added: 1, Removed: 1},
+		uid3: {Removed: 1},
+	}, current.ChangeSummary(prior))
+	require.Equal(t, map[keybase1.UID]DeviceChangeCounts{},
+		current.ChangeSummary(current))
+}
+
+func TestServerHalfRemovalInfoWouldLeaveNoWriters(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	writers := UserDevicePublicKeys{
+		uid1: DevicePublicKeys{key1: true, key2: true},
+	}
+	info := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {makeTestServerHalfID(t, uid1, key1, 0x1)},
+			},
+		},
+		// A reader, which should be ignored.
+		uid2: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key3: {makeTestServerHalfID(t, uid2, key3, 0x2)},
+			},
+		},
+	}
+
+	noWriters, err := info.WouldLeaveNoWriters(writers)
+	require.NoError(t, err)
+	require.False(t, noWriters)
+
+	info[uid1].DeviceServerHalfIDs[key2] = []kbfscrypto.TLFCryptKeyServerHalfID{
+		makeTestServerHalfID(t, uid1, key2, 0x3),
+	}
+	noWriters, err = info.WouldLeaveNoWriters(writers)
+	require.NoError(t, err)
+	require.True(t, noWriters)
+
+	info[uid1].DeviceServerHalfIDs[key3] = []kbfscrypto.TLFCryptKeyServerHalfID{
+		makeTestServerHalfID(t, uid1, key3, 0x4),
+	}
+	_, err = info.WouldLeaveNoWriters(writers)
+	require.Equal(t, fmt.Sprintf(
+		"writer %s doesn't have removed device %s", uid1, key3),
+		err.Error())
+}
+
+func TestServerHalfRemovalInfoHash(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	id1 := makeTestServerHalfID(t, uid1, key1, 0x1)
+	id2 := makeTestServerHalfID(t, uid1, key2, 0x2)
+	id3 := makeTestServerHalfID(t, uid2, key1, 0x3)
+
+	a := make(ServerHalfRemovalInfo)
+	a[uid1] = UserServerHalfRemovalInfo{
+		UserRemoved: true,
+		DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+			key1: {id1},
+			key2: {id2},
+		},
+	}
+	a[uid2] = UserServerHalfRemovalInfo{
+		DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+			key1: {id3},
+		},
+	}
+
+	b := make(ServerHalfRemovalInfo)
+	b[uid2] = UserServerHalfRemovalInfo{
+		DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+			key1: {id3},
+		},
+	}
+	bDevices := make(DeviceServerHalfRemovalInfo)
+	bDevices[key2] = []kbfscrypto.TLFCryptKeyServerHalfID{id2}
+	bDevices[key1] = []kbfscrypto.TLFCryptKeyServerHalfID{id1}
+	b[uid1] = UserServerHalfRemovalInfo{
+		UserRemoved:         true,
+		DeviceServerHalfIDs: bDevices,
+	}
+
+	codec := kbfscodec.NewMsgpack()
+	aHash, err := a.Hash(codec)
+	require.NoError(t, err)
+	require.True(t, aHash.IsValid())
+	bHash, err := b.Hash(codec)
+	require.NoError(t, err)
+	require.Equal(t, aHash, bHash)
+
+	b[uid2] = UserServerHalfRemovalInfo{
+		UserRemoved:         true,
+		DeviceServerHalfIDs: b[uid2].DeviceServerHalfIDs,
+	}
+	bHash, err = b.Hash(codec)
+	require.NoError(t, err)
+	require.NotEqual(t, aHash, bHash)
+
+	// Evicting a removed user with no devices isn't a no-op.
+	uid3 := keybase1.MakeTestUID(0x3)
+	a[uid3] = UserServerHalfRemovalInfo{
+		UserRemoved:         true,
+		DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{},
+	}
+	evictHash, err := a.Hash(codec)
+	require.NoError(t, err)
+	require.NotEqual(t, aHash, evictHash)
+}
+
+func TestSuggestEPubKeyIndexForDevice(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+	uid3 := keybase1.MakeTestUID(0x3)
+
+	infos := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 2},
+			key2: TLFCryptKeyInfo{EPubKeyIndex: 1},
+			key3: TLFCryptKeyInfo{EPubKeyIndex: 2},
+		},
+		uid2: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 1},
+			key2: TLFCryptKeyInfo{EPubKeyIndex: 1},
+		},
+	}
+
+	index, ok := SuggestEPubKeyIndexForDevice(infos, uid1)
+	require.True(t, ok)
+	require.Equal(t, 2, index)
+
+	index, ok = SuggestEPubKeyIndexForDevice(infos, uid2)
+	require.True(t, ok)
+	require.Equal(t, 1, index)
+
+	_, ok = SuggestEPubKeyIndexForDevice(infos, uid3)
+	require.False(t, ok)
+}
+
+func TestServerHalfRemovalInfoSplitByGeneration(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	id1a := makeTestServerHalfID(t, uid1, key1, 0x1)
+	id1b := makeTestServerHalfID(t, uid1, key1, 0x2)
+	id2a := makeTestServerHalfID(t, uid1, key2, 0x3)
+	id2b := makeTestServerHalfID(t, uid1, key2, 0x4)
+	id3a := makeTestServerHalfID(t, uid2, key1, 0x5)
+	id3b := makeTestServerHalfID(t, uid2, key1, 0x6)
+
+	info := ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {id1a, id1b},
+				key2: {id2a, id2b},
+			},
+		},
+		uid2: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {id3a, id3b},
+			},
+		},
+	}
+
+	perGen := info.SplitByGeneration()
+	require.Len(t, perGen, 2)
+	require.Equal(t, ServerHalfRemovalInfo{
+		uid1: UserServerHalfRemovalInfo{
+			UserRemoved: true,
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {id1b},
+				key2: {id2b},
+			},
+		},
+		uid2: UserServerHalfRemovalInfo{
+			DeviceServerHalfIDs: DeviceServerHalfRemovalInfo{
+				key1: {id3b},
+			},
+		},
+	}, perGen[1])
+
+	union, err := UnionServerHalfRemovalInfos(perGen)
+	require.NoError(t, err)
+	require.Equal(t, info, union)
+
+	require.Len(t, ServerHalfRemovalInfo{}.SplitByGeneration(), 0)
+}
+
+func TestValidateEPubKeyIndexSigns(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	infos := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 0},
+			key2: TLFCryptKeyInfo{EPubKeyIndex: 1},
+		},
+		uid2: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: -1},
+		},
+	}
+	readers := UserDevicePublicKeys{
+		uid2: DevicePublicKeys{key1: true},
+	}
+	require.NoError(t, ValidateEPubKeyIndexSigns(infos, readers))
+
+	infos[uid2][key1] = TLFCryptKeyInfo{EPubKeyIndex: 0}
+	err := ValidateEPubKeyIndexSigns(infos, readers)
+	require.Equal(t, fmt.Sprintf(
+		"reader device %s for user %s has non-negative EPubKeyIndex=0",
+		key1, uid2), err.Error())
+
+	infos[uid2][key1] = TLFCryptKeyInfo{EPubKeyIndex: -1}
+	infos[uid1][key2] = TLFCryptKeyInfo{EPubKeyIndex: -2}
+	err = ValidateEPubKeyIndexSigns(infos, readers)
+	require.Equal(t, fmt.Sprintf(
+		"writer device %s for user %s has negative EPubKeyIndex=-2",
+		key2, uid1), err.Error())
+}
+
+func TestValidateV2EPubKeyIndexSigns(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+	uid3 := keybase1.MakeTestUID(0x3)
+
+	// uid3 is a reader keyed by a writer rekey, so it uses a
+	// writer ephemeral key.
+	infos := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 0},
+			key2: TLFCryptKeyInfo{EPubKeyIndex: 1},
+		},
+		uid2: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: -1},
+		},
+		uid3: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 0},
+		},
+	}
+	readerRekeyed := UserDevicePublicKeys{
+		uid2: DevicePublicKeys{key1: true},
+	}
+	require.NoError(t, ValidateV2EPubKeyIndexSigns(infos, readerRekeyed))
+
+	infos[uid2][key1] = TLFCryptKeyInfo{EPubKeyIndex: 0}
+	err := ValidateV2EPubKeyIndexSigns(infos, readerRekeyed)
+	require.Equal(t, fmt.Sprintf(
+		"reader-rekeyed device %s for user %s has non-negative "+
+			"EPubKeyIndex=0", key1, uid2), err.Error())
+
+	infos[uid2][key1] = TLFCryptKeyInfo{EPubKeyIndex: -1}
+	infos[uid1][key2] = TLFCryptKeyInfo{EPubKeyIndex: -2}
+	err = ValidateV2EPubKeyIndexSigns(infos, readerRekeyed)
+	require.Equal(t, fmt.Sprintf(
+		"writer-rekeyed device %s for user %s has negative "+
+			"EPubKeyIndex=-2", key2, uid1), err.Error())
+}
+
+func TestDevicesToResplitForUser(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+	key3 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key3")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	infos := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{EPubKeyIndex: 1},
+			key2: TLFCryptKeyInfo{EPubKeyIndex: 0},
+			key3: TLFCryptKeyInfo{EPubKeyIndex: 1},
+		},
+		uid2: {
+			key2: TLFCryptKeyInfo{EPubKeyIndex: 1},
+		},
+	}
+
+	require.Equal(t, DevicePublicKeys{key1: true, key3: true},
+		DevicesToResplitForUser(infos, uid1, 1))
+	require.Equal(t, DevicePublicKeys{},
+		DevicesToResplitForUser(infos, uid2, 0))
+}
+
+func TestValidateKeyBundleData(t *testing.T) {
+	key1 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key1")
+	key2 := kbfscrypto.MakeFakeCryptPublicKeyOrBust("key2")
+
+	uid1 := keybase1.MakeTestUID(0x1)
+	uid2 := keybase1.MakeTestUID(0x2)
+
+	half1 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x1})
+	half2 := kbfscrypto.MakeTLFCryptKeyServerHalf([32]byte{0x2})
+
+	id1 := makeTestServerHalfID(t, uid1, key1, 0x1)
+	id2 := makeTestServerHalfID(t, uid2, key2, 0x2)
+
+	infos := map[keybase1.UID]map[kbfscrypto.CryptPublicKey]TLFCryptKeyInfo{
+		uid1: {
+			key1: TLFCryptKeyInfo{ServerHalfID: id1, EPubKeyIndex: 0},
+		},
+		uid2: {
+			key2: TLFCryptKeyInfo{ServerHalfID: id2, EPubKeyIndex: -2},
+		},
+	}
+	halves := UserDeviceKeyServerHalves{
+		uid1: DeviceKeyServerHalves{key1: half1},
+		uid2: DeviceKeyServerHalves{key2: half2},
+	}
+	// The reader index is only in range because the reader list
+	// is longer than the writer list.
+	require.NoError(t, ValidateKeyBundleData(infos, halves, 1, 2))
+
+	// An out-of-bounds reader index, and a zero server half.
+	halves[uid1][key1] = kbfscrypto.TLFCryptKeyServerHalf{}
+	err := ValidateKeyBundleData(infos, halves, 2, 1)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), fmt.Sprintf(
+		"reader EPubKeyIndex=-2 (index 1) >= 1 for user %s and device %s",
+		uid2, key2))
+	require.Contains(t, err.Error(), fmt.Sprintf(
+		"zero server half for user %s and device %s", uid1, key1))
+	require.NotContains(t, err.Error(), "writer EPubKeyIndex")
+
+	// An out-of-bounds writer index that would be in range for
+	// the reader list.
+	halves[uid1][key1] = half1
+	infos[uid1][key1] = TLFCryptKeyInfo{ServerHalfID: id1, EPubKeyIndex: 1}
+	err = ValidateKeyBundleData(infos, halves, 1, 2)
+	require.Equal(t, fmt.Sprintf(
+		"writer EPubKeyIndex=1 >= 1 for user %s and device %s",
+		uid1, key1), err.Error())
+
+	// A missing server half, and a duplicate server half ID.
+	infos[uid1][key1] = TLFCryptKeyInfo{ServerHalfID: id1, EPubKeyIndex: 0}
+	delete(halves, uid2)
+	infos[uid2][key2] = TLFCryptKeyInfo{ServerHalfID: id1}
+	err = ValidateKeyBundleData(infos, halves, 2, 2)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), fmt.Sprintf(
+		"key infos and server halves differ for devices "+
+			"[user %s, device %s]", uid2, key2))
+	require.Contains(t, err.Error(), fmt.Sprintf(
+		"server half ID %s is used by 2 devices", id1))
+}
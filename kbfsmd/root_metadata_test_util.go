@@ -44,7 +44,7 @@ func FakeInitialRekey(md MutableRootMetadata,
 	extra, _, err := md.AddKeyGeneration(
 		codec, nil, wKeys, rKeys,
 		kbfscrypto.TLFEphemeralPublicKey{},
-		kbfscrypto.TLFEphemeralPrivateKey{},
+		kbfscrypto.MakeTLFEphemeralPrivateKey([32]byte{0x1}),
 		pubKey, kbfscrypto.TLFCryptKey{}, tlfCryptKey)
 	if err != nil {
 		panic(err)
@@ -111,7 +111,7 @@ func expectRekey(config *ConfigMock, bh tlf.Handle, numDevices int,
 	// generate new keys
 	config.mockCrypto.EXPECT().MakeRandomTLFEphemeralKeys().Return(
 		kbfscrypto.TLFEphemeralPublicKey{},
-		kbfscrypto.TLFEphemeralPrivateKey{}, nil)
+		kbfscrypto.MakeTLFEphemeralPrivateKey([32]byte{0x1}), nil)
 	if expectNewKeyGen {
 		config.mockCrypto.EXPECT().MakeRandomTLFKeys().Return(
 			kbfscrypto.TLFPublicKey{}, kbfscrypto.TLFPrivateKey{},
@@ -303,7 +303,7 @@ func testKeyManagerUncachedSecretKeyForEncryptionSuccess(t *testing.T, ver kbfsm
 		makeDirWKeyInfoMap(uid.AsUserOrBust(), session.CryptPublicKey),
 		kbfsmd.UserDevicePublicKeys{},
 		kbfscrypto.TLFEphemeralPublicKey{},
-		kbfscrypto.TLFEphemeralPrivateKey{},
+		kbfscrypto.MakeTLFEphemeralPrivateKey([32]byte{0x1}),
 		kbfscrypto.TLFPublicKey{}, kbfscrypto.TLFPrivateKey{},
 		kbfscrypto.TLFCryptKey{}, storedTLFCryptKey)
 	require.NoError(t, err)
@@ -334,7 +334,7 @@ func testKeyManagerUncachedSecretKeyForMDDecryptionSuccess(t *testing.T, ver kbf
 	_, err = rmd.AddKeyGeneration(config.Codec(),
 		makeDirWKeyInfoMap(uid.AsUserOrBust(), subkey), kbfsmd.UserDevicePublicKeys{},
 		kbfscrypto.TLFEphemeralPublicKey{},
-		kbfscrypto.TLFEphemeralPrivateKey{},
+		kbfscrypto.MakeTLFEphemeralPrivateKey([32]byte{0x1}),
 		kbfscrypto.TLFPublicKey{}, kbfscrypto.TLFPrivateKey{},
 		kbfscrypto.TLFCryptKey{}, storedTLFCryptKey)
 	require.NoError(t, err)
@@ -368,7 +368,7 @@ func testKeyManagerUncachedSecretKeyForBlockDecryptionSuccess(t *testing.T, ver
 		makeDirWKeyInfoMap(uid.AsUserOrBust(), session.CryptPublicKey),
 		kbfsmd.UserDevicePublicKeys{},
 		kbfscrypto.TLFEphemeralPublicKey{},
-		kbfscrypto.TLFEphemeralPrivateKey{},
+		kbfscrypto.MakeTLFEphemeralPrivateKey([32]byte{0x1}),
 		kbfscrypto.TLFPublicKey{}, kbfscrypto.TLFPrivateKey{},
 		kbfscrypto.TLFCryptKey{}, storedTLFCryptKey1)
 	require.NoError(t, err)
@@ -381,7 +381,7 @@ func testKeyManagerUncachedSecretKeyForBlockDecryptionSuccess(t *testing.T, ver
 		makeDirWKeyInfoMap(uid.AsUserOrBust(), session.CryptPublicKey),
 		kbfsmd.UserDevicePublicKeys{},
 		kbfscrypto.TLFEphemeralPublicKey{},
-		kbfscrypto.TLFEphemeralPrivateKey{},
+		kbfscrypto.MakeTLFEphemeralPrivateKey([32]byte{0x1}),
 		kbfscrypto.TLFPublicKey{}, kbfscrypto.TLFPrivateKey{},
 		currCryptKey, storedTLFCryptKey2)
 	require.NoError(t, err)
@@ -849,7 +849,7 @@ func testKeyManagerRekeyResolveAgainNoChangeSuccessPrivate(t *testing.T, ver kbf
 	oldKeyGen = rmd.LatestKeyGeneration()
 	config.mockCrypto.EXPECT().MakeRandomTLFEphemeralKeys().Return(
 		kbfscrypto.TLFEphemeralPublicKey{},
-		kbfscrypto.TLFEphemeralPrivateKey{}, nil)
+		kbfscrypto.MakeTLFEphemeralPrivateKey([32]byte{0x1}), nil)
 
 	subkey := kbfscrypto.MakeFakeCryptPublicKeyOrBust("crypt public key")
 	config.mockKbpki.EXPECT().GetCryptPublicKeys(gomock.Any(), gomock.Any()).